@@ -0,0 +1,294 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type AssocContact struct {
+	Email string `gorm:"serializer:D1"`
+	Phone string `gorm:"serializer:D1"`
+}
+
+type AssocAudit struct {
+	Note string `gorm:"serializer:D1"`
+}
+
+type AssocUser struct {
+	ID      int
+	Name    string
+	SSN     string       `gorm:"serializer:D1"`
+	Contact AssocContact `gorm:"embedded;embeddedPrefix:contact_"`
+	AssocAudit
+	Profile   AssocProfile
+	Accounts  []AssocAccount
+	Languages []AssocLanguage `gorm:"many2many:assoc_user_languages"`
+	Toys      []AssocToy      `gorm:"polymorphic:Owner"`
+	CompanyID *int
+	Company   *AssocCompany
+}
+
+type AssocProfile struct {
+	ID          int
+	AssocUserID int
+	Bio         string `gorm:"serializer:D1"`
+}
+
+type AssocAccount struct {
+	ID          int
+	AssocUserID int
+	Number      string `gorm:"serializer:D1"`
+	Balance     []byte `gorm:"serializer:D1"`
+}
+
+type AssocLanguage struct {
+	ID   int
+	Code string
+	Name string `gorm:"serializer:D1"`
+}
+
+type AssocToy struct {
+	ID        int
+	OwnerID   int
+	OwnerType string
+	Secret    string `gorm:"serializer:D1"`
+}
+
+type AssocCompany struct {
+	ID   int
+	Name string `gorm:"serializer:D1"`
+}
+
+func newAssocTestDB(t *testing.T) (*gorm.DB, *AssocUser) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	db := testutil.NewTestDB(t)
+	err := db.Use(NewPlugin())
+	assert.Nil(t, err)
+	err = db.AutoMigrate(&AssocUser{}, &AssocProfile{}, &AssocAccount{}, &AssocLanguage{}, &AssocToy{}, &AssocCompany{})
+	assert.Nil(t, err)
+
+	user := &AssocUser{
+		ID:         1,
+		Name:       "John",
+		SSN:        "123-45-6789",
+		Contact:    AssocContact{Email: "john@example.com", Phone: "12345678"},
+		AssocAudit: AssocAudit{Note: "audited"},
+		Profile:    AssocProfile{ID: 1, Bio: "bio"},
+		Accounts:   []AssocAccount{{ID: 1, Number: "DK001", Balance: []byte("100")}, {ID: 2, Number: "DK002", Balance: []byte("200")}},
+		Languages:  []AssocLanguage{{ID: 1, Code: "da", Name: "Danish"}},
+		Toys:       []AssocToy{{ID: 1, Secret: "teddy"}},
+		Company:    &AssocCompany{ID: 1, Name: "CYBERCRYPT"},
+	}
+	err = db.Create(user).Error
+	assert.Nil(t, err)
+	return db, user
+}
+
+// assertCiphertext checks that the raw values of the columns of a table are ciphertexts of the expected plaintexts.
+func assertCiphertext(t *testing.T, db *gorm.DB, table string, columns map[string][]string) {
+	for column, plaintexts := range columns {
+		rows, err := db.Table(table).Select(column).Order("rowid").Rows()
+		assert.Nil(t, err)
+
+		var raw []interface{}
+		for rows.Next() {
+			var value interface{}
+			err = rows.Scan(&value)
+			assert.Nil(t, err)
+			raw = append(raw, value)
+		}
+		assert.Nil(t, rows.Close())
+		assert.Len(t, raw, len(plaintexts), "%s.%s", table, column)
+
+		for i, value := range raw {
+			var stored []byte
+			switch value := value.(type) {
+			case string:
+				stored, err = base64.StdEncoding.DecodeString(value)
+				assert.Nil(t, err, "%s.%s", table, column)
+			case []byte:
+				stored = value
+			default:
+				t.Errorf("%s.%s: unexpected type %T", table, column, value)
+			}
+			assert.Equal(t, "encrypted:"+plaintexts[i], string(stored), "%s.%s", table, column)
+		}
+	}
+}
+
+func TestAssociationsCreate(t *testing.T) {
+	db, _ := newAssocTestDB(t)
+
+	assertCiphertext(t, db, "assoc_users", map[string][]string{
+		"ssn":           {"123-45-6789"},
+		"contact_email": {"john@example.com"},
+		"contact_phone": {"12345678"},
+		"note":          {"audited"},
+	})
+	assertCiphertext(t, db, "assoc_profiles", map[string][]string{"bio": {"bio"}})
+	assertCiphertext(t, db, "assoc_accounts", map[string][]string{"number": {"DK001", "DK002"}, "balance": {"100", "200"}})
+	assertCiphertext(t, db, "assoc_languages", map[string][]string{"name": {"Danish"}})
+	assertCiphertext(t, db, "assoc_toys", map[string][]string{"secret": {"teddy"}})
+	assertCiphertext(t, db, "assoc_companies", map[string][]string{"name": {"CYBERCRYPT"}})
+}
+
+func TestAssociationsPreload(t *testing.T) {
+	db, user := newAssocTestDB(t)
+
+	found := &AssocUser{}
+	err := db.Preload("Profile").Preload("Accounts").Preload("Languages").Preload("Toys").Preload("Company").First(found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, user, found)
+}
+
+func TestAssociationsJoins(t *testing.T) {
+	db, user := newAssocTestDB(t)
+
+	found := &AssocUser{}
+	err := db.Joins("Profile").Joins("Company").First(found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, user.Profile, found.Profile)
+	assert.Equal(t, user.Company, found.Company)
+	assert.Equal(t, user.Contact, found.Contact)
+
+	// Only the selected columns are decrypted
+	found = &AssocUser{}
+	err = db.Select("assoc_users.id", "assoc_users.ssn").Joins("Profile").First(found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "123-45-6789", found.SSN)
+	assert.Equal(t, "bio", found.Profile.Bio)
+	assert.Empty(t, found.Contact)
+
+	// Columns selected from joined tables are decrypted when scanned into DTOs
+	type UserBio struct {
+		Name  string
+		SSN   string
+		Bio   string
+		Email string
+	}
+	var bios []UserBio
+	err = db.Model(&AssocUser{}).
+		Select("assoc_users.name", "assoc_users.ssn", "Profile.bio", "assoc_users.contact_email AS email").
+		Joins("Profile").
+		Find(&bios).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []UserBio{{"John", "123-45-6789", "bio", "john@example.com"}}, bios)
+}
+
+type AssocOrg struct {
+	ID   int
+	Name string `gorm:"serializer:D1"`
+}
+
+type AssocMember struct {
+	ID    int
+	Name  string
+	OrgID int
+	Org   AssocOrg
+}
+
+func TestAssociationsPlainColumnOfSameName(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+	db := testutil.NewTestDB(t)
+	err := db.Use(NewPlugin())
+	assert.Nil(t, err)
+	err = db.AutoMigrate(&AssocOrg{}, &AssocMember{})
+	assert.Nil(t, err)
+	err = db.Create(&AssocMember{ID: 1, Name: "John", Org: AssocOrg{ID: 1, Name: "CYBERCRYPT"}}).Error
+	assert.Nil(t, err)
+
+	// The plaintext name of the member is not mistaken for the encrypted name of its organization
+	type MemberName struct {
+		Name string
+	}
+	var names []MemberName
+	err = db.Model(&AssocMember{}).Find(&names).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []MemberName{{"John"}}, names)
+
+	var plucked []string
+	err = db.Model(&AssocMember{}).Pluck("name", &plucked).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"John"}, plucked)
+
+	// The name of the organization is decrypted when qualified by the name of the joined relationship
+	type MemberOrg struct {
+		Name    string
+		OrgName string
+	}
+	var orgs []MemberOrg
+	err = db.Model(&AssocMember{}).Select("assoc_members.name", "Org.name AS org_name").Joins("Org").Find(&orgs).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []MemberOrg{{"John", "CYBERCRYPT"}}, orgs)
+}
+
+func TestAssociationsFullSave(t *testing.T) {
+	db, user := newAssocTestDB(t)
+
+	user.SSN = "987-65-4321"
+	user.Contact.Email = "jim@example.com"
+	user.Profile.Bio = "new bio"
+	user.Accounts[1].Number = "DK003"
+	user.Accounts = append(user.Accounts, AssocAccount{ID: 3, Number: "DK004", Balance: []byte("300")})
+	user.Languages[0].Name = "Dansk"
+	user.Toys[0].Secret = "robot"
+	user.Company.Name = "CYBERCRYPT A/S"
+	err := db.Session(&gorm.Session{FullSaveAssociations: true}).Updates(user).Error
+	assert.Nil(t, err)
+
+	assertCiphertext(t, db, "assoc_users", map[string][]string{"ssn": {"987-65-4321"}, "contact_email": {"jim@example.com"}})
+	assertCiphertext(t, db, "assoc_profiles", map[string][]string{"bio": {"new bio"}})
+	assertCiphertext(t, db, "assoc_accounts", map[string][]string{"number": {"DK001", "DK003", "DK004"}})
+	assertCiphertext(t, db, "assoc_languages", map[string][]string{"name": {"Dansk"}})
+	assertCiphertext(t, db, "assoc_toys", map[string][]string{"secret": {"robot"}})
+	assertCiphertext(t, db, "assoc_companies", map[string][]string{"name": {"CYBERCRYPT A/S"}})
+
+	found := &AssocUser{}
+	err = db.Preload("Profile").Preload("Accounts").Preload("Languages").Preload("Toys").Preload("Company").First(found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, user, found)
+}
+
+func TestAssociationsAppend(t *testing.T) {
+	db, user := newAssocTestDB(t)
+
+	err := db.Model(user).Association("Accounts").Append(&AssocAccount{ID: 3, Number: "DK003", Balance: []byte("300")})
+	assert.Nil(t, err)
+	err = db.Model(user).Association("Languages").Append(&AssocLanguage{ID: 2, Code: "en", Name: "English"})
+	assert.Nil(t, err)
+	assertCiphertext(t, db, "assoc_accounts", map[string][]string{"number": {"DK001", "DK002", "DK003"}})
+	assertCiphertext(t, db, "assoc_languages", map[string][]string{"name": {"Danish", "English"}})
+
+	var accounts []AssocAccount
+	err = db.Model(user).Association("Accounts").Find(&accounts)
+	assert.Nil(t, err)
+	numbers := make([]string, len(accounts))
+	for i, account := range accounts {
+		numbers[i] = account.Number
+	}
+	assert.Equal(t, "DK001,DK002,DK003", strings.Join(numbers, ","))
+	assert.NotContains(t, fmt.Sprint(accounts), "encrypted:")
+}
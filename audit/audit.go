@@ -0,0 +1,67 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package audit provides a Cryptor that keeps an audit trail of all the decryptions performed through it.
+package audit
+
+import (
+	"context"
+	"time"
+)
+
+// Outcome is the outcome of an audited decryption.
+type Outcome string
+
+const (
+	// OutcomeSuccess is the outcome of a decryption that succeeded.
+	OutcomeSuccess Outcome = "success"
+	// OutcomeFailure is the outcome of a decryption that failed.
+	OutcomeFailure Outcome = "failure"
+)
+
+// Record describes a single decryption.
+type Record struct {
+	// Identity is the identity of the caller, as returned by the identity function of the Cryptor.
+	Identity string
+	// Table, Column and PrimaryKey identify the decrypted value. They are empty if the Cryptor was not called by the D1Serializer.
+	Table      string
+	Column     string
+	PrimaryKey string
+	// Timestamp is the time of the decryption.
+	Timestamp time.Time
+	// Purpose is the purpose of the decryption, as set with WithPurpose.
+	Purpose string
+	Outcome Outcome
+	// Error is the error returned by the decryption, if it failed.
+	Error string
+}
+
+// Sink receives the records of the decryptions in batches. Write is never called concurrently by a Cryptor.
+type Sink interface {
+	Write(ctx context.Context, records []Record) error
+}
+
+type purposeCtxKey struct{}
+
+// WithPurpose returns a copy of ctx that carries the purpose of the decryptions performed with it, e.g. the ID of a support ticket. The purpose is
+// recorded in the audit trail.
+func WithPurpose(ctx context.Context, purpose string) context.Context {
+	return context.WithValue(ctx, purposeCtxKey{}, purpose)
+}
+
+// PurposeFromContext returns the purpose carried by ctx, if any.
+func PurposeFromContext(ctx context.Context) (string, bool) {
+	purpose, ok := ctx.Value(purposeCtxKey{}).(string)
+	return purpose, ok
+}
@@ -0,0 +1,211 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package audit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm/schema"
+
+	d1gorm "github.com/cybercryptio/d1-gorm"
+	"github.com/cybercryptio/d1-gorm/crypto"
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type sinkMock struct {
+	mu      sync.Mutex
+	batches [][]Record
+}
+
+func (s *sinkMock) Write(ctx context.Context, records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, records)
+	return nil
+}
+
+func (s *sinkMock) records() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []Record
+	for _, batch := range s.batches {
+		records = append(records, batch...)
+	}
+	return records
+}
+
+func TestCryptorRecords(t *testing.T) {
+	type Person struct {
+		ID        int
+		FirstName string
+		LastName  string `gorm:"serializer:D1"`
+	}
+
+	ErrDecrypt := fmt.Errorf("decryption error")
+
+	cryptorMock := &testutil.CryptorMock{}
+	cryptorMock.On("Encrypt", mock.Anything, []byte("Doe")).Once().Return([]byte("Doencrypt"), nil)
+	cryptorMock.On("Encrypt", mock.Anything, []byte("Roe")).Once().Return([]byte("Roencrypt"), nil)
+	cryptorMock.On("Decrypt", mock.Anything, []byte("Doencrypt")).Once().Return([]byte("Doe"), nil)
+	cryptorMock.On("Decrypt", mock.Anything, []byte("Roencrypt")).Once().Return(nil, ErrDecrypt)
+
+	sink := &sinkMock{}
+	cryptor := NewCryptor(cryptorMock, sink, WithBatchSize(1))
+	schema.RegisterSerializer("D1", d1gorm.NewD1Serializer(cryptor))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&Person{})
+	assert.Nil(t, err)
+
+	err = db.Create(&[]Person{{1, "John", "Doe"}, {2, "Jane", "Roe"}}).Error
+	assert.Nil(t, err)
+
+	ctx := WithPurpose(crypto.ContextWithIdentity(context.Background(), "alice"), "ticket-42")
+	before := time.Now()
+	err = db.WithContext(ctx).Order("id").Find(&[]Person{}).Error
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	err = cryptor.Close()
+	assert.Nil(t, err)
+
+	records := sink.records()
+	assert.Len(t, records, 2)
+	assert.Len(t, sink.batches, 2)
+
+	for i, record := range records {
+		assert.Equal(t, "alice", record.Identity)
+		assert.Equal(t, "ticket-42", record.Purpose)
+		assert.Equal(t, "people", record.Table)
+		assert.Equal(t, "last_name", record.Column)
+		assert.Equal(t, fmt.Sprint(i+1), record.PrimaryKey)
+		assert.False(t, record.Timestamp.Before(before))
+	}
+	assert.Equal(t, OutcomeSuccess, records[0].Outcome)
+	assert.Empty(t, records[0].Error)
+	assert.Equal(t, OutcomeFailure, records[1].Outcome)
+	assert.Equal(t, ErrDecrypt.Error(), records[1].Error)
+
+	_, err = cryptor.Decrypt(ctx, []byte("Doencrypt"))
+	assert.ErrorIs(t, err, ErrClosed)
+	cryptorMock.AssertExpectations(t)
+}
+
+func TestCryptorFlushInterval(t *testing.T) {
+	cryptorMock := &testutil.CryptorMock{}
+	cryptorMock.On("Decrypt", mock.Anything, []byte("Doencrypt")).Return([]byte("Doe"), nil)
+
+	sink := &sinkMock{}
+	cryptor := NewCryptor(cryptorMock, sink, WithFlushInterval(10*time.Millisecond))
+	defer cryptor.Close()
+
+	_, err := cryptor.Decrypt(context.Background(), []byte("Doencrypt"))
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool { return len(sink.records()) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+// blockingCryptor blocks decryptions until release is closed.
+type blockingCryptor struct {
+	testutil.CryptorMock
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingCryptor) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	close(c.started)
+	<-c.release
+	return []byte("Doe"), nil
+}
+
+func TestCryptorCloseDuringDecrypt(t *testing.T) {
+	blocking := &blockingCryptor{started: make(chan struct{}), release: make(chan struct{})}
+	sink := &sinkMock{}
+	cryptor := NewCryptor(blocking, sink, WithFlushInterval(0))
+
+	decrypted := make(chan error)
+	go func() {
+		_, err := cryptor.Decrypt(context.Background(), []byte("Doencrypt"))
+		decrypted <- err
+	}()
+	<-blocking.started
+
+	// Close does not wait for the decryptions in flight, which are not returned since they cannot be recorded
+	err := cryptor.Close()
+	assert.Nil(t, err)
+	close(blocking.release)
+	assert.ErrorIs(t, <-decrypted, ErrClosed)
+	assert.Empty(t, sink.records())
+}
+
+func TestTableSink(t *testing.T) {
+	db := testutil.NewTestDB(t)
+	sink, err := NewTableSink(db)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	for batch := 0; batch < 3; batch++ {
+		records := make([]Record, 5)
+		for i := range records {
+			records[i] = Record{
+				Identity:   "alice",
+				Table:      "people",
+				Column:     "last_name",
+				PrimaryKey: fmt.Sprint(batch*len(records) + i),
+				Timestamp:  time.Now(),
+				Outcome:    OutcomeSuccess,
+			}
+		}
+		err = sink.Write(ctx, records)
+		assert.Nil(t, err)
+	}
+
+	var count int64
+	err = db.Model(&Entry{}).Count(&count).Error
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), count)
+
+	err = VerifyChain(db)
+	assert.Nil(t, err)
+
+	// Modifications through gorm are rejected
+	err = db.Model(&Entry{}).Where("id = ?", 7).Update("identity", "mallory").Error
+	assert.ErrorIs(t, err, ErrAppendOnly)
+	err = db.Delete(&Entry{}, 7).Error
+	assert.ErrorIs(t, err, ErrAppendOnly)
+
+	// Modifications with raw SQL break the chain
+	err = db.Exec("UPDATE d1gorm_audit_entries SET identity = ? WHERE id = ?", "mallory", 7).Error
+	assert.Nil(t, err)
+	err = VerifyChain(db)
+	assert.ErrorIs(t, err, ErrChainBroken)
+	assert.ErrorContains(t, err, "entry 7")
+
+	err = db.Exec("UPDATE d1gorm_audit_entries SET identity = ? WHERE id = ?", "alice", 7).Error
+	assert.Nil(t, err)
+	err = VerifyChain(db)
+	assert.Nil(t, err)
+
+	err = db.Exec("DELETE FROM d1gorm_audit_entries WHERE id = ?", 12).Error
+	assert.Nil(t, err)
+	err = VerifyChain(db)
+	assert.ErrorIs(t, err, ErrChainBroken)
+	assert.ErrorContains(t, err, "entry 13")
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package audit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// ErrClosed is returned when decrypting with a Cryptor that has been closed.
+var ErrClosed = fmt.Errorf("the audit cryptor is closed")
+
+// Cryptor is an implementation of the Cryptor interface that records every call to Decrypt on the wrapped Cryptor. The records are written to the
+// Sink asynchronously and in batches, so that decryptions are not slowed down by the Sink. Close must be called to flush the pending records.
+type Cryptor struct {
+	cryptor crypto.Cryptor
+	sink    Sink
+	opts    options
+
+	mu      sync.RWMutex
+	closed  bool
+	records chan Record
+	done    chan struct{}
+}
+
+// NewCryptor creates a new Cryptor that records the decryptions of the provided Cryptor to the provided Sink.
+func NewCryptor(cryptor crypto.Cryptor, sink Sink, opts ...Option) *Cryptor {
+	o := defaultOptions()
+	o.apply(opts...)
+
+	c := &Cryptor{
+		cryptor: cryptor,
+		sink:    sink,
+		opts:    o,
+		records: make(chan Record, o.bufferSize),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Encrypt calls Encrypt on the wrapped Cryptor. Encryptions are not audited.
+func (c *Cryptor) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return c.cryptor.Encrypt(ctx, plaintext)
+}
+
+// Decrypt calls Decrypt on the wrapped Cryptor and records the decryption. If the Cryptor is closed before the decryption is recorded, the plaintext
+// is not returned.
+func (c *Cryptor) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+
+	plaintext, err := c.cryptor.Decrypt(ctx, ciphertext)
+
+	record := Record{
+		Identity:  c.opts.identity(ctx),
+		Timestamp: time.Now(),
+		Outcome:   OutcomeSuccess,
+	}
+	if info, ok := crypto.FieldInfoFromContext(ctx); ok {
+		record.Table = info.Table
+		record.Column = info.Column
+		record.PrimaryKey = info.PrimaryKey
+	}
+	if purpose, ok := PurposeFromContext(ctx); ok {
+		record.Purpose = purpose
+	}
+	if err != nil {
+		record.Outcome = OutcomeFailure
+		record.Error = err.Error()
+	}
+	if !c.enqueue(record) {
+		return nil, ErrClosed
+	}
+
+	return plaintext, err
+}
+
+func (c *Cryptor) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+// enqueue adds a record to the records waiting to be written to the Sink. It returns false if the Cryptor is closed.
+func (c *Cryptor) enqueue(record Record) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return false
+	}
+	c.records <- record
+	return true
+}
+
+// Close stops the Cryptor and writes the pending records to the Sink. Decryptions performed after Close return ErrClosed.
+func (c *Cryptor) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.records)
+	}
+	c.mu.Unlock()
+
+	<-c.done
+	return nil
+}
+
+// run writes the records to the Sink, when a batch is full or when the flush interval has passed.
+func (c *Cryptor) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.opts.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, c.opts.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := c.sink.Write(context.Background(), batch); err != nil {
+			c.opts.errorHandler(err)
+		}
+		batch = make([]Record, 0, c.opts.batchSize)
+	}
+
+	for {
+		select {
+		case record, ok := <-c.records:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= c.opts.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package audit
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultBufferSize    = 10000
+	defaultFlushInterval = time.Second
+)
+
+type options struct {
+	batchSize     int
+	bufferSize    int
+	flushInterval time.Duration
+	identity      func(ctx context.Context) string
+	errorHandler  func(err error)
+}
+
+// Option is used to configure optional settings for the audit Cryptor.
+type Option func(*options)
+
+func defaultOptions() options {
+	return options{
+		batchSize:     defaultBatchSize,
+		bufferSize:    defaultBufferSize,
+		flushInterval: defaultFlushInterval,
+		identity: func(ctx context.Context) string {
+			identity, _ := crypto.IdentityFromContext(ctx)
+			return identity
+		},
+		errorHandler: func(err error) {
+			log.Printf("d1gorm: failed to write audit records: %v", err)
+		},
+	}
+}
+
+func (o *options) apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithBatchSize sets the maximum number of records written to the Sink at once. The default batch size is 100.
+func WithBatchSize(batchSize int) Option {
+	return func(o *options) {
+		o.batchSize = batchSize
+	}
+}
+
+// WithBufferSize sets the number of records that can be waiting to be written to the Sink. When the buffer is full, decryptions block until there
+// is room for their records. The default buffer size is 10000.
+func WithBufferSize(bufferSize int) Option {
+	return func(o *options) {
+		o.bufferSize = bufferSize
+	}
+}
+
+// WithFlushInterval sets the maximum time a record waits before being written to the Sink. The default flush interval is 1 second, which is also
+// used when the provided interval is not positive.
+func WithFlushInterval(flushInterval time.Duration) Option {
+	return func(o *options) {
+		if flushInterval <= 0 {
+			flushInterval = defaultFlushInterval
+		}
+		o.flushInterval = flushInterval
+	}
+}
+
+// WithIdentityFunc sets the function used to extract the identity of the caller from the context. The default is crypto.IdentityFromContext.
+func WithIdentityFunc(identity func(ctx context.Context) string) Option {
+	return func(o *options) {
+		o.identity = identity
+	}
+}
+
+// WithErrorHandler sets the function called when writing records to the Sink fails. The default logs the error with the standard logger.
+func WithErrorHandler(errorHandler func(err error)) Option {
+	return func(o *options) {
+		o.errorHandler = errorHandler
+	}
+}
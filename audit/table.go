@@ -0,0 +1,182 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrAppendOnly is returned when trying to update or delete entries of the audit table through gorm.
+var ErrAppendOnly = fmt.Errorf("the audit table is append-only")
+
+// ErrChainBroken is returned by VerifyChain when the hash chain of the audit table does not match its entries.
+var ErrChainBroken = fmt.Errorf("the hash chain of the audit table is broken")
+
+// Entry is a Record stored in the audit table. Every entry holds the hash of the previous entry and its own hash, computed over its contents and the
+// previous hash, so that modifying or deleting entries breaks the chain.
+type Entry struct {
+	ID           uint64 `gorm:"primaryKey;autoIncrement"`
+	Identity     string
+	Table        string `gorm:"column:audited_table"`
+	Column       string `gorm:"column:audited_column"`
+	PrimaryKey   string `gorm:"column:audited_primary_key"`
+	Timestamp    time.Time
+	Purpose      string
+	Outcome      Outcome
+	Error        string
+	PreviousHash string
+	Hash         string
+}
+
+// TableName returns the name of the audit table.
+func (Entry) TableName() string {
+	return "d1gorm_audit_entries"
+}
+
+// TableSink is an implementation of the Sink interface that appends the records to an audit table managed by gorm. The table is protected by a
+// hash chain, which can be checked with VerifyChain. TableSink assumes it is the only writer of the audit table.
+type TableSink struct {
+	db *gorm.DB
+}
+
+// NewTableSink creates the audit table in the provided database, if it does not exist, and returns a TableSink that writes to it. It also registers
+// callbacks that reject updates and deletions of the audit entries made through gorm. Note that this does not prevent modifications made with raw
+// SQL, which should be prevented with the permissions of the database user.
+func NewTableSink(db *gorm.DB) (*TableSink, error) {
+	if err := db.AutoMigrate(&Entry{}); err != nil {
+		return nil, err
+	}
+	if err := registerAppendOnly(db); err != nil {
+		return nil, err
+	}
+	return &TableSink{db: db}, nil
+}
+
+// Write appends the records to the audit table, extending the hash chain.
+func (s *TableSink) Write(ctx context.Context, records []Record) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var last []Entry
+		if err := tx.Order("id desc").Limit(1).Find(&last).Error; err != nil {
+			return err
+		}
+
+		previousHash := ""
+		if len(last) > 0 {
+			previousHash = last[0].Hash
+		}
+
+		entries := make([]Entry, len(records))
+		for i, record := range records {
+			entries[i] = Entry{
+				Identity:     record.Identity,
+				Table:        record.Table,
+				Column:       record.Column,
+				PrimaryKey:   record.PrimaryKey,
+				Timestamp:    canonicalTime(record.Timestamp),
+				Purpose:      record.Purpose,
+				Outcome:      record.Outcome,
+				Error:        record.Error,
+				PreviousHash: previousHash,
+			}
+			entries[i].Hash = entries[i].computeHash()
+			previousHash = entries[i].Hash
+		}
+
+		return tx.Create(&entries).Error
+	})
+}
+
+// VerifyChain reads all the entries of the audit table in the provided database and verifies that the hash chain is intact. It returns an error
+// wrapping ErrChainBroken, with the ID of the first inconsistent entry, if it is not.
+func VerifyChain(db *gorm.DB) error {
+	var (
+		entries      []Entry
+		previousHash string
+		chainErr     error
+	)
+
+	result := db.Order("id").FindInBatches(&entries, defaultBatchSize, func(tx *gorm.DB, batch int) error {
+		for _, entry := range entries {
+			if entry.PreviousHash != previousHash || entry.Hash != entry.computeHash() {
+				chainErr = fmt.Errorf("entry %d: %w", entry.ID, ErrChainBroken)
+				return chainErr
+			}
+			previousHash = entry.Hash
+		}
+		return nil
+	})
+	if chainErr != nil {
+		return chainErr
+	}
+	return result.Error
+}
+
+// canonicalTime returns the time in UTC with a precision of a millisecond, which can be stored by all the supported databases.
+func canonicalTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+// computeHash returns the hash of the entry, which covers all its fields except the ID and the hash itself.
+func (e Entry) computeHash() string {
+	h := sha256.New()
+	for _, field := range []string{
+		e.PreviousHash,
+		e.Identity,
+		e.Table,
+		e.Column,
+		e.PrimaryKey,
+		canonicalTime(e.Timestamp).Format(time.RFC3339Nano),
+		e.Purpose,
+		string(e.Outcome),
+		e.Error,
+	} {
+		// Each field is prefixed with its length, so that the encoding is unambiguous.
+		var length [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(length[:], uint64(len(field)))
+		h.Write(length[:n])
+		h.Write([]byte(field))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func registerAppendOnly(db *gorm.DB) error {
+	const name = "d1gorm:audit:append_only"
+
+	rejectAuditEntries := func(db *gorm.DB) {
+		if db.Statement.Schema != nil && db.Statement.Schema.Table == (Entry{}).TableName() {
+			_ = db.AddError(ErrAppendOnly)
+		}
+	}
+
+	callback := db.Callback()
+	if callback.Update().Get(name) == nil {
+		if err := callback.Update().Before("gorm:update").Register(name, rejectAuditEntries); err != nil {
+			return err
+		}
+	}
+	if callback.Delete().Get(name) == nil {
+		if err := callback.Delete().Before("gorm:delete").Register(name, rejectAuditEntries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
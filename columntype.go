@@ -0,0 +1,155 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// defaultCryptorOverhead is the default number of bytes the Cryptor is assumed to add to a plaintext: the object ID, and the nonce, tag and
+// metadata of a D1 ciphertext.
+const defaultCryptorOverhead = 256
+
+// columnTypeSetter is implemented by the types of encrypted fields that pick their column type themselves, through gorm's GormDBDataType.
+type columnTypeSetter interface {
+	GormDBDataType(db *gorm.DB, field *schema.Field) string
+}
+
+// AutoMigrate runs db.AutoMigrate for the models, with the columns of their fields tagged with `gorm:"serializer:D1"` created with a type suited to
+// their ciphertext rather than the type gorm picks for the field, e.g. varchar(191) for a string on MySQL. The type depends on the dialect, on
+// whether the ciphertext is stored as binary ([]byte) or base64 encoded text (string), and on the maximum plaintext size in bytes set with the
+// size setting of the d1 tag, e.g. `d1:"size=64"`. Text columns get a case-sensitive collation on MySQL and SQL Server, as base64 is case-sensitive.
+// Fields with a type set by their gorm tag keep it. Encrypted and Secret fields pick their type with any AutoMigrate.
+//
+// The types are recorded in the schemas of the models cached by db, so that later migrations of the models with db use them as well.
+func AutoMigrate(db *gorm.DB, models ...interface{}) error {
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+
+		for _, field := range stmt.Schema.Fields {
+			if _, ok := field.TagSettings["TYPE"]; ok {
+				continue
+			}
+			if _, ok := reflect.New(field.IndirectFieldType).Interface().(columnTypeSetter); ok {
+				continue
+			}
+			if dataType := columnType(db, field); dataType != "" {
+				field.DataType = schema.DataType(dataType)
+			}
+		}
+	}
+	return db.AutoMigrate(models...)
+}
+
+// columnType returns the column type suited to the ciphertext of a field encrypted by the D1Serializer in the dialect of db, or an empty string if
+// the field is not encrypted or the dialect is not known.
+func columnType(db *gorm.DB, field *schema.Field) string {
+	serializer, ok := field.Serializer.(D1Serializer)
+	if !ok {
+		return ""
+	}
+
+	text, ok := storedAsText(field.IndirectFieldType)
+	if !ok {
+		return ""
+	}
+
+	size, bounded := serializer.maxStoredSize(field, text)
+	switch db.Dialector.Name() {
+	case "postgres":
+		if text {
+			return "text"
+		}
+		return "bytea"
+	case "mysql":
+		// base64 is case-sensitive, so text columns use a binary collation rather than the case-insensitive default of the server.
+		const ascii = " CHARACTER SET ascii COLLATE ascii_bin"
+		switch {
+		case bounded && size <= 16383 && text:
+			return fmt.Sprintf("varchar(%d)", size) + ascii
+		case bounded && size <= 16383:
+			return fmt.Sprintf("varbinary(%d)", size)
+		case bounded && size <= 16777215 && text:
+			return "mediumtext" + ascii
+		case bounded && size <= 16777215:
+			return "mediumblob"
+		case text:
+			return "longtext" + ascii
+		default:
+			return "longblob"
+		}
+	case "sqlserver":
+		length := "max"
+		if bounded && size <= 8000 {
+			length = strconv.Itoa(size)
+		}
+		if text {
+			return "varchar(" + length + ") COLLATE Latin1_General_BIN2"
+		}
+		return "varbinary(" + length + ")"
+	case "sqlite":
+		if text {
+			return "text"
+		}
+		return "blob"
+	default:
+		return ""
+	}
+}
+
+// storedAsText returns true if the ciphertext of a field of type t is stored base64 encoded, and false if it is stored as binary. It returns false
+// as its second value if t cannot be encrypted.
+func storedAsText(t reflect.Type) (bool, bool) {
+	switch v := reflect.New(t).Elem().Interface().(type) {
+	case string:
+		return true, true
+	case []byte:
+		return false, true
+	case lazyValue:
+		return v.isText(), true
+	case secretValue:
+		_, text := v.exposed().(string)
+		return text, true
+	default:
+		return false, false
+	}
+}
+
+// maxStoredSize returns the maximum size of the value stored for a field, given the maximum plaintext size set with its d1 tag. It returns false if
+// the field has no maximum plaintext size.
+func (s D1Serializer) maxStoredSize(field *schema.Field, text bool) (int, bool) {
+	size, err := strconv.Atoi(tagSettings(field)["size"])
+	if err != nil || size < 0 {
+		return 0, false
+	}
+
+	// Compressed values are only stored if they are smaller than their plaintext.
+	if padding, err := paddingOf(field, s.opts.padding); err == nil && padding.enabled {
+		size = padding.size(size + 1)
+	}
+	size += len(envelopeMagic) + 1 + s.opts.cryptorOverhead
+	if text {
+		size = (size + 2) / 3 * 4
+	}
+	return size, true
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type PersonColumns struct {
+	ID        int
+	FirstName string
+	LastName  string            `gorm:"serializer:D1"`
+	Notes     []byte            `gorm:"serializer:D1"`
+	SSN       string            `gorm:"serializer:D1" d1:"size=11"`
+	Photo     []byte            `gorm:"serializer:D1" d1:"size=100000"`
+	Email     Encrypted[string] `gorm:"serializer:D1" d1:"size=64"`
+	Phone     Secret[string]    `gorm:"serializer:D1"`
+	Nickname  Secret[string]
+	Custom    string `gorm:"serializer:D1;type:varchar(500)"`
+}
+
+// namedDialector is a dialector that only reports a name, to compute the column types of other dialects.
+type namedDialector struct {
+	gorm.Dialector
+	name string
+}
+
+func (d namedDialector) Name() string {
+	return d.name
+}
+
+func TestColumnType(t *testing.T) {
+	serializer := NewD1Serializer(slowCryptor{})
+	schema.RegisterSerializer("D1", serializer)
+	sch, err := schema.Parse(&PersonColumns{}, &sync.Map{}, schema.NamingStrategy{})
+	assert.Nil(t, err)
+
+	// 11 bytes of plaintext, the header and the overhead of the Cryptor, base64 encoded
+	ssnSize := (11 + 4 + defaultCryptorOverhead + 2) / 3 * 4
+	tests := map[string]map[string]string{
+		"mysql": {
+			"first_name": "", "last_name": "longtext CHARACTER SET ascii COLLATE ascii_bin", "notes": "longblob",
+			"ssn": "varchar(364) CHARACTER SET ascii COLLATE ascii_bin", "photo": "mediumblob",
+			"email": "varchar(432) CHARACTER SET ascii COLLATE ascii_bin", "phone": "longtext CHARACTER SET ascii COLLATE ascii_bin",
+			"nickname": "",
+		},
+		"postgres": {
+			"first_name": "", "last_name": "text", "notes": "bytea", "ssn": "text", "photo": "bytea", "email": "text", "phone": "text",
+		},
+		"sqlserver": {
+			"last_name": "varchar(max) COLLATE Latin1_General_BIN2", "notes": "varbinary(max)", "ssn": "varchar(364) COLLATE Latin1_General_BIN2",
+			"photo": "varbinary(max)", "email": "varchar(432) COLLATE Latin1_General_BIN2",
+		},
+		"sqlite":  {"last_name": "text", "notes": "blob", "ssn": "text", "photo": "blob", "email": "text"},
+		"unknown": {"last_name": "", "notes": ""},
+	}
+	assert.Equal(t, 364, ssnSize)
+
+	for dialect, columns := range tests {
+		db := &gorm.DB{Config: &gorm.Config{Dialector: namedDialector{name: dialect}}}
+		for column, expected := range columns {
+			assert.Equal(t, expected, columnType(db, sch.LookUpField(column)), "%s %s", dialect, column)
+		}
+	}
+
+	// Padding and text encoding are taken into account
+	field := sch.LookUpField("ssn")
+	size, bounded := NewD1Serializer(slowCryptor{}, WithPadding(), WithCryptorOverhead(40)).maxStoredSize(field, false)
+	assert.True(t, bounded)
+	assert.Equal(t, 16+4+40, size)
+
+	_, bounded = serializer.maxStoredSize(sch.LookUpField("last_name"), true)
+	assert.False(t, bounded)
+}
+
+func TestAutoMigrate(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	db := testutil.NewTestDB(t)
+	err := AutoMigrate(db, &PersonColumns{})
+	assert.Nil(t, err)
+
+	columnTypes, err := db.Migrator().ColumnTypes(&PersonColumns{})
+	assert.Nil(t, err)
+	types := map[string]string{}
+	for _, columnType := range columnTypes {
+		types[columnType.Name()] = strings.ToLower(columnType.DatabaseTypeName())
+	}
+	assert.Equal(t, map[string]string{
+		"id": "integer", "first_name": "text", "last_name": "text", "notes": "blob", "ssn": "text", "photo": "blob", "email": "text",
+		"phone": "text", "nickname": "text", "custom": "varchar",
+	}, types)
+
+	// Binary ciphertexts are stored as blobs
+	person := PersonColumns{ID: 1, Notes: []byte("note"), Photo: []byte{0xff, 0x00}}
+	err = db.Create(&person).Error
+	assert.Nil(t, err)
+
+	var found PersonColumns
+	err = db.First(&found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, person.Notes, found.Notes)
+	assert.Equal(t, person.Photo, found.Photo)
+
+	// Migrating again keeps the types
+	err = AutoMigrate(db, &PersonColumns{})
+	assert.Nil(t, err)
+}
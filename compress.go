@@ -0,0 +1,62 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// Error returned when a compressed value decompresses to more than the maximum size set with WithMaxDecompressedSize.
+var ErrDecompressedSizeExceeded = fmt.Errorf("the decompressed size of the value is exceeded")
+
+// defaultMaxDecompressedSize is the default maximum size of a decompressed value.
+const defaultMaxDecompressedSize = 64 << 20
+
+// compress returns the plaintext compressed with gzip.
+func compress(plaintext []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns the plaintext compressed by compress, or an error if it exceeds maxSize bytes. The plaintext is never decompressed beyond the
+// limit.
+func decompress(compressed []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, crypto.ErrInvalidFormat)
+	}
+	defer r.Close()
+
+	plaintext, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, crypto.ErrInvalidFormat)
+	}
+	if len(plaintext) > maxSize {
+		return nil, fmt.Errorf("%w: the limit is %d bytes", ErrDecompressedSizeExceeded, maxSize)
+	}
+	return plaintext, nil
+}
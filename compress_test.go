@@ -0,0 +1,119 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type PersonDocument struct {
+	ID       int
+	Document []byte            `gorm:"serializer:D1"`
+	Notes    Encrypted[string] `gorm:"serializer:D1"`
+}
+
+func TestCompression(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}, WithCompression(64)))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&PersonDocument{})
+	assert.Nil(t, err)
+
+	random := make([]byte, 1024)
+	_, err = rand.Read(random)
+	assert.Nil(t, err)
+
+	people := []PersonDocument{
+		{ID: 1, Document: bytes.Repeat([]byte(`{"name":"John Doe"}`), 100)},
+		{ID: 2, Document: []byte("short")},
+		{ID: 3, Document: random},
+	}
+	err = db.Create(&people).Error
+	assert.Nil(t, err)
+
+	var stored []PersonDocument
+	err = db.Session(&gorm.Session{Context: WithoutDecryption(context.Background())}).Order("id").Find(&stored).Error
+	assert.Nil(t, err)
+
+	// Only the values above the threshold that shrink are compressed
+	assert.True(t, bytes.HasPrefix(stored[0].Document, append(append([]byte{}, envelopeMagic...), flagCompressed)))
+	assert.Less(t, len(stored[0].Document), len(people[0].Document)/10)
+	assert.Equal(t, []byte("encrypted:short"), stored[1].Document)
+	assert.Equal(t, append([]byte("encrypted:"), random...), stored[2].Document)
+
+	// Compressed values are read by any serializer
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+	var found []PersonDocument
+	err = reopenTestDB(t, db).Order("id").Find(&found).Error
+	assert.Nil(t, err)
+	assert.Equal(t, people, found)
+}
+
+func TestCompressionWithPadding(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}, WithCompression(1), WithPadding()))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&PersonDocument{})
+	assert.Nil(t, err)
+
+	notes := string(bytes.Repeat([]byte("note "), 100))
+	err = db.Create(&PersonDocument{ID: 1, Document: bytes.Repeat([]byte("a"), 1000), Notes: NewEncrypted(notes)}).Error
+	assert.Nil(t, err)
+
+	var found PersonDocument
+	err = db.First(&found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("a"), 1000), found.Document)
+
+	revealed, err := found.Notes.Reveal(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, notes, revealed)
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}, WithCompression(1)))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&PersonDocument{})
+	assert.Nil(t, err)
+
+	bomb := make([]byte, 1<<20)
+	err = db.Create(&PersonDocument{ID: 1, Document: bomb, Notes: NewEncrypted(string(bomb))}).Error
+	assert.Nil(t, err)
+
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}, WithMaxDecompressedSize(1024)))
+	db = reopenTestDB(t, db)
+	err = db.Omit("notes").First(&PersonDocument{}, 1).Error
+	assert.ErrorIs(t, err, ErrDecompressedSizeExceeded)
+
+	var found PersonDocument
+	err = db.Select("id", "notes").First(&found, 1).Error
+	assert.Nil(t, err)
+	_, err = found.Notes.Reveal(context.Background())
+	assert.ErrorIs(t, err, ErrDecompressedSizeExceeded)
+
+	_, err = decompress([]byte("not gzip"), 1024)
+	assert.ErrorIs(t, err, crypto.ErrInvalidFormat)
+}
@@ -18,6 +18,8 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/google/uuid"
+
 	client "github.com/cybercryptio/d1-client-go/v2/d1-generic"
 	pbgeneric "github.com/cybercryptio/d1-client-go/v2/d1-generic/protobuf/generic"
 )
@@ -30,41 +32,91 @@ type Cryptor interface {
 
 // D1Cryptor is an implementation of the Cryptor interface that uses the D1 Generic Service to encrypt and decrypt data.
 type D1Cryptor struct {
-	d1Client client.GenericClient
+	d1Client        client.GenericClient
+	compactObjectID bool
+}
+
+// D1CryptorOption is used to configure optional settings for the D1Cryptor.
+type D1CryptorOption func(*D1Cryptor)
+
+// WithCompactObjectID makes the D1Cryptor prefix the ciphertexts with the 16-byte binary form of the object ID, marked by CompactObjectIDMarker,
+// instead of its 36-character textual form. This saves 20 bytes per value. Decrypt reads both forms, so existing data remains readable.
+func WithCompactObjectID() D1CryptorOption {
+	return func(c *D1Cryptor) {
+		c.compactObjectID = true
+	}
 }
 
 // NewD1Cryptor creates a new D1Cryptor instance that uses the provided client to connect to the D1 Generic Service. All the database queries across
 // all the connections will use this client to encrypt and decrypt data, when necessary.
-func NewD1Cryptor(d1Client client.GenericClient) D1Cryptor {
-	return D1Cryptor{d1Client: d1Client}
+func NewD1Cryptor(d1Client client.GenericClient, opts ...D1CryptorOption) D1Cryptor {
+	c := D1Cryptor{d1Client: d1Client}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
 }
 
 // Encrypt calls the D1 Generic Service to encrypt the provided plaintext and returns the concatenation of object ID + ciphertext to be stored in the
-// database.
+// database. The object ID is in its compact form if the D1Cryptor was created WithCompactObjectID, and if it is a UUID.
 func (c D1Cryptor) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
 	res, err := c.d1Client.Generic.Encrypt(ctx, &pbgeneric.EncryptRequest{Plaintext: plaintext})
 	if err != nil {
 		return nil, err
 	}
+
+	if c.compactObjectID {
+		if id, err := uuid.Parse(res.ObjectId); err == nil && len(res.ObjectId) == UUIDLength {
+			return append(append([]byte{CompactObjectIDMarker}, id[:]...), res.Ciphertext...), nil
+		}
+	}
 	return append([]byte(res.ObjectId), res.Ciphertext...), nil
 }
 
 // The ciphertext stored in the database is a concatenation of the object ID (of length UUIDLength) and the actual ciphertext.
 const UUIDLength = 36
 
+// CompactObjectIDMarker starts the ciphertexts whose object ID is stored in its binary form, of length CompactUUIDLength. It cannot start the
+// textual form of a UUID.
+const CompactObjectIDMarker byte = 0x01
+
+// CompactUUIDLength is the length of the binary form of an object ID.
+const CompactUUIDLength = 16
+
 // ErrInvalidFormat is returned when the ciphertext is not in the correct format (object ID of UUIDLength + ciphertext).
 var ErrInvalidFormat = fmt.Errorf("the format of the ciphertext is invalid")
 
-// Decrypt parses the database ciphertext to extract the object ID and calls the D1 Generic Service to decrypt the ciphertext and return the
-// plaintext.
-func (c D1Cryptor) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+// ObjectID splits a ciphertext produced by the D1Cryptor into the textual form of its object ID and the actual ciphertext. Both the textual and the
+// compact forms of the object ID are recognized.
+func ObjectID(ciphertext []byte) (string, []byte, error) {
+	if len(ciphertext) > 0 && ciphertext[0] == CompactObjectIDMarker {
+		if len(ciphertext) < 1+CompactUUIDLength {
+			return "", nil, ErrInvalidFormat
+		}
+		id, err := uuid.FromBytes(ciphertext[1 : 1+CompactUUIDLength])
+		if err != nil {
+			return "", nil, ErrInvalidFormat
+		}
+		return id.String(), ciphertext[1+CompactUUIDLength:], nil
+	}
+
 	if len(ciphertext) < UUIDLength {
-		return nil, ErrInvalidFormat
+		return "", nil, ErrInvalidFormat
+	}
+	return string(ciphertext[:UUIDLength]), ciphertext[UUIDLength:], nil
+}
+
+// Decrypt parses the database ciphertext to extract the object ID, in either form, and calls the D1 Generic Service to decrypt the ciphertext and
+// return the plaintext.
+func (c D1Cryptor) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	objectID, ciphertext, err := ObjectID(ciphertext)
+	if err != nil {
+		return nil, err
 	}
 
 	res, err := c.d1Client.Generic.Decrypt(ctx, &pbgeneric.DecryptRequest{
-		ObjectId:   string(ciphertext[:UUIDLength]),
-		Ciphertext: ciphertext[UUIDLength:],
+		ObjectId:   objectID,
+		Ciphertext: ciphertext,
 	})
 	if err != nil {
 		return nil, err
@@ -0,0 +1,82 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+
+	client "github.com/cybercryptio/d1-client-go/v2/d1-generic"
+	pbgeneric "github.com/cybercryptio/d1-client-go/v2/d1-generic/protobuf/generic"
+)
+
+// genericServiceFake is a fake of the D1 Generic Service, which "encrypts" by prefixing the plaintext with a fixed object ID.
+type genericServiceFake struct {
+	objectID string
+}
+
+func (f genericServiceFake) Encrypt(ctx context.Context, in *pbgeneric.EncryptRequest, opts ...grpc.CallOption) (*pbgeneric.EncryptResponse, error) {
+	return &pbgeneric.EncryptResponse{ObjectId: f.objectID, Ciphertext: append([]byte("ciphertext:"), in.Plaintext...)}, nil
+}
+
+func (f genericServiceFake) Decrypt(ctx context.Context, in *pbgeneric.DecryptRequest, opts ...grpc.CallOption) (*pbgeneric.DecryptResponse, error) {
+	if in.ObjectId != f.objectID {
+		return nil, ErrInvalidFormat
+	}
+	return &pbgeneric.DecryptResponse{Plaintext: bytes.TrimPrefix(in.Ciphertext, []byte("ciphertext:"))}, nil
+}
+
+func TestD1CryptorCompactObjectID(t *testing.T) {
+	id := uuid.New()
+	d1Client := client.GenericClient{Generic: genericServiceFake{objectID: id.String()}}
+	legacy := NewD1Cryptor(d1Client)
+	compact := NewD1Cryptor(d1Client, WithCompactObjectID())
+
+	legacyCiphertext, err := legacy.Encrypt(context.Background(), []byte("plaintext"))
+	assert.Nil(t, err)
+	assert.Equal(t, id.String()+"ciphertext:plaintext", string(legacyCiphertext))
+
+	compactCiphertext, err := compact.Encrypt(context.Background(), []byte("plaintext"))
+	assert.Nil(t, err)
+	assert.Equal(t, append(append([]byte{CompactObjectIDMarker}, id[:]...), "ciphertext:plaintext"...), compactCiphertext)
+	assert.Equal(t, len(legacyCiphertext)-UUIDLength+1+CompactUUIDLength, len(compactCiphertext))
+
+	// Both forms are decrypted by both cryptors
+	for _, cryptor := range []D1Cryptor{legacy, compact} {
+		for _, ciphertext := range [][]byte{legacyCiphertext, compactCiphertext} {
+			plaintext, err := cryptor.Decrypt(context.Background(), ciphertext)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("plaintext"), plaintext)
+		}
+	}
+
+	_, err = compact.Decrypt(context.Background(), []byte{CompactObjectIDMarker, 1, 2, 3})
+	assert.ErrorIs(t, err, ErrInvalidFormat)
+	_, err = compact.Decrypt(context.Background(), []byte("short"))
+	assert.ErrorIs(t, err, ErrInvalidFormat)
+}
+
+func TestD1CryptorCompactObjectIDFallback(t *testing.T) {
+	// Object IDs that are not UUIDs are stored in their textual form
+	d1Client := client.GenericClient{Generic: genericServiceFake{objectID: "not-a-uuid"}}
+	ciphertext, err := NewD1Cryptor(d1Client, WithCompactObjectID()).Encrypt(context.Background(), []byte("plaintext"))
+	assert.Nil(t, err)
+	assert.Equal(t, "not-a-uuidciphertext:plaintext", string(ciphertext))
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package crypto
+
+import (
+	"context"
+)
+
+// FieldInfo describes the database field whose value is being encrypted or decrypted. It is attached to the context passed to a Cryptor by the
+// D1Serializer, so that Cryptor implementations wrapping other Cryptors can use it for instrumentation.
+type FieldInfo struct {
+	// Table is the name of the database table.
+	Table string
+	// Column is the name of the database column.
+	Column string
+	// PrimaryKey is the primary key of the database row, formatted as a string. Composite primary keys are separated by commas. It is empty if the
+	// primary key is not known, e.g. when creating a row with an auto-incremented primary key.
+	PrimaryKey string
+}
+
+type fieldInfoCtxKey struct{}
+
+// ContextWithFieldInfo returns a copy of ctx that carries the provided field information.
+func ContextWithFieldInfo(ctx context.Context, info FieldInfo) context.Context {
+	return context.WithValue(ctx, fieldInfoCtxKey{}, info)
+}
+
+// FieldInfoFromContext returns the field information carried by ctx, if any.
+func FieldInfoFromContext(ctx context.Context) (FieldInfo, bool) {
+	info, ok := ctx.Value(fieldInfoCtxKey{}).(FieldInfo)
+	return info, ok
+}
+
+type identityCtxKey struct{}
+
+// ContextWithIdentity returns a copy of ctx that carries the identity of the caller. The identity is used by Cryptor implementations that audit or
+// limit the operations performed on behalf of a caller.
+func ContextWithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityCtxKey{}, identity)
+}
+
+// IdentityFromContext returns the identity of the caller carried by ctx, if any.
+func IdentityFromContext(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityCtxKey{}).(string)
+	return identity, ok
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// ErrNotSerialized is returned when writing an Encrypted field that is not tagged with the D1Serializer.
+var ErrNotSerialized = fmt.Errorf("encrypted fields must be tagged with the D1 serializer")
+
+// Encrypted holds the value of a field encrypted by the D1Serializer, which is only decrypted when Reveal is called. Loading a model therefore does
+// not call the Cryptor for its Encrypted fields, and only the code that needs the plaintext pays for its decryption. The field must be tagged with
+// `gorm:"serializer:D1"`, and is stored in the same format as a string or []byte field encrypted by the D1Serializer.
+//
+// An Encrypted value that was read from the database and not modified is written back as is, without calling the Cryptor. The zero value is
+// written as NULL. An Encrypted value is not safe for concurrent use.
+type Encrypted[T string | []byte] struct {
+	ciphertext []byte
+	serializer D1Serializer
+	info       crypto.FieldInfo
+
+	plaintext T
+	revealed  bool
+	modified  bool
+}
+
+// NewEncrypted creates a new Encrypted value holding the provided plaintext, to be encrypted when written to the database.
+func NewEncrypted[T string | []byte](value T) Encrypted[T] {
+	var e Encrypted[T]
+	e.Set(value)
+	return e
+}
+
+// Set replaces the value with the provided plaintext, to be encrypted when written to the database.
+func (e *Encrypted[T]) Set(value T) {
+	*e = Encrypted[T]{plaintext: value, revealed: true, modified: true}
+}
+
+// Reveal returns the plaintext of the value, decrypting it with the Cryptor of the D1Serializer that read it the first time it is called. Errors
+// are returned as a *FieldError.
+func (e *Encrypted[T]) Reveal(ctx context.Context) (T, error) {
+	if e.revealed || e.ciphertext == nil {
+		return e.plaintext, nil
+	}
+
+	plaintext, err := e.serializer.decryptStored(crypto.ContextWithFieldInfo(ctx, e.info), e.ciphertext)
+	if err != nil {
+		var zero T
+		return zero, &FieldError{Table: e.info.Table, Column: e.info.Column, PrimaryKey: e.info.PrimaryKey, Operation: OperationDecrypt, Err: err}
+	}
+
+	e.plaintext = T(plaintext)
+	e.revealed = true
+	return e.plaintext, nil
+}
+
+// Value implements driver.Valuer, so that the zero value is written as NULL. Other values are written by the D1Serializer.
+func (e Encrypted[T]) Value() (driver.Value, error) {
+	if e.ciphertext == nil && !e.modified {
+		return nil, nil
+	}
+	return nil, ErrNotSerialized
+}
+
+// GormDBDataType implements gorm's GormDBDataType, so that AutoMigrate creates the column with a type suited to the ciphertext, see AutoMigrate.
+func (e Encrypted[T]) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return columnType(db, field)
+}
+
+// pending returns the plaintext to be encrypted when the value is written, if it was set.
+func (e Encrypted[T]) pending() ([]byte, bool) {
+	return []byte(e.plaintext), e.modified
+}
+
+// stored returns the ciphertext the value was read with.
+func (e Encrypted[T]) stored() []byte {
+	return e.ciphertext
+}
+
+// isText returns true if the plaintext is a string, in which case the ciphertext is stored base64 encoded.
+func (e Encrypted[T]) isText() bool {
+	_, ok := interface{}(e.plaintext).(string)
+	return ok
+}
+
+// load sets the ciphertext read from the database, along with what is needed to decrypt it later. The ciphertext is retained, so it must not be
+// owned by the driver.
+func (e *Encrypted[T]) load(serializer D1Serializer, info crypto.FieldInfo, ciphertext []byte) {
+	*e = Encrypted[T]{ciphertext: ciphertext, serializer: serializer, info: info}
+}
+
+// lazyValue is implemented by Encrypted, and lets the D1Serializer write it.
+type lazyValue interface {
+	pending() ([]byte, bool)
+	stored() []byte
+	isText() bool
+}
+
+// lazyScanner is implemented by *Encrypted, and lets the D1Serializer read it.
+type lazyScanner interface {
+	lazyValue
+	load(serializer D1Serializer, info crypto.FieldInfo, ciphertext []byte)
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+func TestEncrypted(t *testing.T) {
+	type PersonLazy struct {
+		ID       int
+		LastName Encrypted[string] `gorm:"serializer:D1"`
+		Notes    Encrypted[[]byte] `gorm:"serializer:D1"`
+	}
+
+	type PersonLazyString struct {
+		ID       int
+		LastName string `gorm:"serializer:D1"`
+		Notes    []byte `gorm:"serializer:D1"`
+	}
+
+	cryptor := &testutil.CryptorMock{}
+	cryptor.On("Encrypt", mock.Anything, []byte("Doe")).Once().Return([]byte("Doencrypt"), nil)
+	cryptor.On("Encrypt", mock.Anything, []byte("Roe")).Once().Return([]byte("Roencrypt"), nil)
+	cryptor.On("Decrypt", mock.Anything, []byte("Doencrypt")).Return([]byte("Doe"), nil)
+	cryptor.On("Decrypt", mock.Anything, []byte("Roencrypt")).Return([]byte("Roe"), nil)
+	schema.RegisterSerializer("D1", NewD1Serializer(cryptor))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&PersonLazy{})
+	assert.Nil(t, err)
+
+	err = db.Create(&PersonLazy{ID: 1, LastName: NewEncrypted("Doe")}).Error
+	assert.Nil(t, err)
+	cryptor.AssertNumberOfCalls(t, "Encrypt", 1)
+
+	// Loading the model does not decrypt it
+	ctx := context.Background()
+	person := &PersonLazy{}
+	err = db.First(person).Error
+	assert.Nil(t, err)
+	cryptor.AssertNumberOfCalls(t, "Decrypt", 0)
+
+	// The plaintext is decrypted once
+	for i := 0; i < 2; i++ {
+		lastName, err := person.LastName.Reveal(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, "Doe", lastName)
+	}
+	cryptor.AssertNumberOfCalls(t, "Decrypt", 1)
+	info, ok := crypto.FieldInfoFromContext(cryptor.Calls[len(cryptor.Calls)-1].Arguments.Get(0).(context.Context))
+	assert.True(t, ok)
+	assert.Equal(t, crypto.FieldInfo{Table: "person_lazies", Column: "last_name", PrimaryKey: "1"}, info)
+
+	// The zero value is stored as NULL
+	notes, err := person.Notes.Reveal(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, notes)
+
+	// Unmodified values are written back without being encrypted again
+	err = db.Save(person).Error
+	assert.Nil(t, err)
+	cryptor.AssertNumberOfCalls(t, "Encrypt", 1)
+
+	// The stored format is the same as for string fields
+	stringPerson := &PersonLazyString{}
+	err = db.Table("person_lazies").First(stringPerson).Error
+	assert.Nil(t, err)
+	assert.Equal(t, PersonLazyString{ID: 1, LastName: "Doe"}, *stringPerson)
+
+	person.LastName.Set("Roe")
+	err = db.Save(person).Error
+	assert.Nil(t, err)
+	cryptor.AssertNumberOfCalls(t, "Encrypt", 2)
+
+	person = &PersonLazy{}
+	err = db.First(person).Error
+	assert.Nil(t, err)
+	lastName, err := person.LastName.Reveal(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Roe", lastName)
+
+	cryptor.AssertExpectations(t)
+}
+
+func TestEncryptedRevealError(t *testing.T) {
+	type PersonLazy struct {
+		ID       int
+		LastName Encrypted[string] `gorm:"serializer:D1"`
+	}
+
+	cryptor := &testutil.CryptorMock{}
+	cryptor.On("Encrypt", mock.Anything, []byte("Doe")).Once().Return([]byte("Doencrypt"), nil)
+	cryptor.On("Decrypt", mock.Anything, []byte("Doencrypt")).Return(nil, status.Error(codes.PermissionDenied, "denied"))
+	schema.RegisterSerializer("D1", NewD1Serializer(cryptor))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&PersonLazy{})
+	assert.Nil(t, err)
+
+	err = db.Create(&PersonLazy{ID: 1, LastName: NewEncrypted("Doe")}).Error
+	assert.Nil(t, err)
+
+	person := &PersonLazy{}
+	err = db.First(person).Error
+	assert.Nil(t, err)
+
+	_, err = person.LastName.Reveal(context.Background())
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+	var fieldErr *FieldError
+	assert.ErrorAs(t, err, &fieldErr)
+	assert.Equal(t, "last_name", fieldErr.Column)
+}
+
+func TestEncryptedReusedBuffer(t *testing.T) {
+	type PersonLazy struct {
+		ID    int
+		Notes Encrypted[[]byte] `gorm:"serializer:D1"`
+	}
+
+	serializer := NewD1Serializer(slowCryptor{})
+	schema.RegisterSerializer("D1", serializer)
+	sch, err := schema.Parse(&PersonLazy{}, &sync.Map{}, schema.NamingStrategy{})
+	assert.Nil(t, err)
+
+	// The driver reuses its buffer for the next row before the value is revealed
+	buffer := []byte("encrypted:note")
+	person := &PersonLazy{}
+	err = serializer.Scan(context.Background(), sch.LookUpField("Notes"), reflect.ValueOf(person).Elem(), buffer)
+	assert.Nil(t, err)
+	copy(buffer, "encrypted:next")
+
+	notes, err := person.Notes.Reveal(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("note"), notes)
+}
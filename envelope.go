@@ -0,0 +1,88 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// envelopeMagic starts the stored values whose format is recorded in a header, which is followed by a byte of flags and the ciphertext. Values
+// stored without any flag have no header, so values written by earlier versions, and by serializers without the options that need one, remain
+// readable. The ciphertexts of the D1Cryptor start with the ASCII object ID, so they never start with a zero byte.
+var envelopeMagic = []byte{0x00, 'd', '1'}
+
+// Flags recording how the plaintext was transformed before being encrypted.
+const (
+	// flagPadded is set when the plaintext is padded, see padding.
+	flagPadded byte = 1 << iota
+	// flagCompressed is set when the plaintext is compressed with gzip, before being padded.
+	flagCompressed
+
+	knownFlags = flagPadded | flagCompressed
+)
+
+// wrapEnvelope returns the value to store for a ciphertext, prefixed with a header recording the flags if any is set.
+func wrapEnvelope(flags byte, ciphertext []byte) []byte {
+	if flags == 0 {
+		return ciphertext
+	}
+	stored := make([]byte, 0, len(envelopeMagic)+1+len(ciphertext))
+	stored = append(stored, envelopeMagic...)
+	stored = append(stored, flags)
+	return append(stored, ciphertext...)
+}
+
+// openEnvelope returns the flags and the ciphertext of a stored value.
+func openEnvelope(stored []byte) (byte, []byte, error) {
+	if !bytes.HasPrefix(stored, envelopeMagic) {
+		return 0, stored, nil
+	}
+	if len(stored) <= len(envelopeMagic) {
+		return 0, nil, crypto.ErrInvalidFormat
+	}
+
+	flags := stored[len(envelopeMagic)]
+	if flags&^knownFlags != 0 {
+		return 0, nil, fmt.Errorf("unknown flags %#x: %w", flags&^knownFlags, crypto.ErrInvalidFormat)
+	}
+	return flags, stored[len(envelopeMagic)+1:], nil
+}
+
+// decryptStored decrypts a stored value with the Cryptor, and reverts the transformations recorded in its header.
+func (s D1Serializer) decryptStored(ctx context.Context, stored []byte) ([]byte, error) {
+	flags, ciphertext, err := openEnvelope(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := s.cryptor.Decrypt(ctx, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&flagPadded != 0 {
+		if plaintext, err = unpad(plaintext); err != nil {
+			return nil, err
+		}
+	}
+	if flags&flagCompressed != 0 {
+		return decompress(plaintext, s.opts.maxDecompressedSize)
+	}
+	return plaintext, nil
+}
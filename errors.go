@@ -0,0 +1,91 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors matching the errors returned by the D1 Generic Service, by gRPC status code. They can be tested for with errors.Is on the errors returned
+// by gorm for statements that failed in the D1Serializer.
+var (
+	// ErrUnauthenticated is matched by errors with the gRPC status code Unauthenticated.
+	ErrUnauthenticated = fmt.Errorf("the caller is not authenticated")
+	// ErrPermissionDenied is matched by errors with the gRPC status code PermissionDenied.
+	ErrPermissionDenied = fmt.Errorf("the caller does not have permission to access the object")
+	// ErrObjectNotFound is matched by errors with the gRPC status code NotFound.
+	ErrObjectNotFound = fmt.Errorf("the object was not found")
+	// ErrUnavailable is matched by errors with the gRPC status code Unavailable.
+	ErrUnavailable = fmt.Errorf("the D1 service is unavailable")
+)
+
+var grpcErrors = map[codes.Code]error{
+	codes.Unauthenticated:  ErrUnauthenticated,
+	codes.PermissionDenied: ErrPermissionDenied,
+	codes.NotFound:         ErrObjectNotFound,
+	codes.Unavailable:      ErrUnavailable,
+}
+
+// Operation is the operation performed by the D1Serializer when an error occurred.
+type Operation string
+
+const (
+	// OperationEncrypt is the operation of encrypting a field before writing it to the database.
+	OperationEncrypt Operation = "encrypt"
+	// OperationDecrypt is the operation of decrypting a field after reading it from the database.
+	OperationDecrypt Operation = "decrypt"
+)
+
+// FieldError is the error returned by the D1Serializer when it fails to encrypt or decrypt a field. It wraps the cause of the failure, and matches
+// ErrUnauthenticated, ErrPermissionDenied, ErrObjectNotFound and ErrUnavailable according to the gRPC status code of the cause.
+type FieldError struct {
+	Table  string
+	Column string
+	// PrimaryKey is the primary key of the row, formatted as a string. It is empty if the primary key is not known.
+	PrimaryKey string
+	Operation  Operation
+	Err        error
+}
+
+func (e *FieldError) Error() string {
+	if e.PrimaryKey == "" {
+		return fmt.Sprintf("failed to %s %s.%s: %v", e.Operation, e.Table, e.Column, e.Err)
+	}
+	return fmt.Sprintf("failed to %s %s.%s with primary key %s: %v", e.Operation, e.Table, e.Column, e.PrimaryKey, e.Err)
+}
+
+// Unwrap returns the cause of the error.
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the error matching the gRPC status code of the cause.
+func (e *FieldError) Is(target error) bool {
+	err, ok := grpcErrors[grpcCode(e.Err)]
+	return ok && err == target
+}
+
+// grpcCode returns the gRPC status code of the first error in the chain of err that has one, or codes.Unknown.
+func grpcCode(err error) codes.Code {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		return grpcErr.GRPCStatus().Code()
+	}
+	return codes.Unknown
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+func TestFieldErrorDecrypt(t *testing.T) {
+	type PersonString struct {
+		ID        int
+		FirstName string
+		LastName  string `gorm:"serializer:D1"`
+	}
+
+	cryptor := &testutil.CryptorMock{}
+	cryptor.On("Encrypt", mock.Anything, []byte("Doe")).Once().Return([]byte("Doencrypt"), nil)
+	cryptor.On("Encrypt", mock.Anything, []byte("Roe")).Once().Return([]byte("Roencrypt"), nil)
+	cryptor.On("Decrypt", mock.Anything, []byte("Doencrypt")).Once().Return(nil, status.Error(codes.PermissionDenied, "denied"))
+	cryptor.On("Decrypt", mock.Anything, []byte("Roencrypt")).Once().Return(nil, crypto.ErrInvalidFormat)
+	schema.RegisterSerializer("D1", NewD1Serializer(cryptor))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&PersonString{})
+	assert.Nil(t, err)
+
+	err = db.Create(&[]PersonString{{1, "John", "Doe"}, {2, "Jane", "Roe"}}).Error
+	assert.Nil(t, err)
+
+	err = db.First(&PersonString{}, 1).Error
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+	assert.False(t, errors.Is(err, ErrUnavailable))
+
+	var fieldErr *FieldError
+	assert.True(t, errors.As(err, &fieldErr))
+	assert.Equal(t, "person_strings", fieldErr.Table)
+	assert.Equal(t, "last_name", fieldErr.Column)
+	assert.Equal(t, "1", fieldErr.PrimaryKey)
+	assert.Equal(t, OperationDecrypt, fieldErr.Operation)
+	assert.Equal(t, codes.PermissionDenied, status.Code(fieldErr.Err))
+	assert.EqualError(t, err, "failed to decrypt person_strings.last_name with primary key 1: rpc error: code = PermissionDenied desc = denied")
+
+	err = db.First(&PersonString{}, 2).Error
+	assert.ErrorIs(t, err, crypto.ErrInvalidFormat)
+	assert.False(t, errors.Is(err, ErrPermissionDenied))
+	assert.True(t, errors.As(err, &fieldErr))
+	assert.Equal(t, "2", fieldErr.PrimaryKey)
+
+	cryptor.AssertExpectations(t)
+}
+
+func TestFieldErrorEncrypt(t *testing.T) {
+	type PersonString struct {
+		ID        int
+		FirstName string
+		LastName  string `gorm:"serializer:D1"`
+	}
+
+	cryptor := &testutil.CryptorMock{}
+	cryptor.On("Encrypt", mock.Anything, []byte("Doe")).Return(nil, status.Error(codes.Unavailable, "unavailable"))
+	schema.RegisterSerializer("D1", NewD1Serializer(cryptor))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&PersonString{})
+	assert.Nil(t, err)
+
+	err = db.Create(&PersonString{FirstName: "John", LastName: "Doe"}).Error
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	var fieldErr *FieldError
+	assert.True(t, errors.As(err, &fieldErr))
+	assert.Equal(t, "person_strings", fieldErr.Table)
+	assert.Equal(t, "last_name", fieldErr.Column)
+	assert.Empty(t, fieldErr.PrimaryKey)
+	assert.Equal(t, OperationEncrypt, fieldErr.Operation)
+
+	cryptor.AssertExpectations(t)
+}
@@ -0,0 +1,255 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// ErrInvalidGroup is returned when the sealed field groups of a model are not defined correctly.
+var ErrInvalidGroup = fmt.Errorf("invalid sealed field group")
+
+// ErrPartialGroupUpdate is returned when an update writes only the non-zero fields of a model, e.g. with Updates, and sets members of a sealed
+// field group. The group is stored as a whole, so its other members would be cleared. Update all of its fields instead, with Save or Select("*"),
+// or select the field storing the group.
+var ErrPartialGroupUpdate = fmt.Errorf("the members of a sealed field group cannot be updated partially")
+
+// sealedGroup is a group of fields sealed into a single encrypted column. Fields are added to a group with the d1 tag, e.g. `gorm:"-"
+// d1:"group=profile"`, and the group is stored in the encrypted field whose name or column is the name of the group, e.g.
+// `Profile []byte gorm:"serializer:D1"`. The fields of a group are serialized as a JSON object, so that a row costs a single encryption and the
+// columns do not reveal which attributes are set.
+type sealedGroup struct {
+	column  *schema.Field
+	members []*schema.Field
+}
+
+// sealedGroups caches the sealed groups of the schemas, or the error found when parsing them.
+var sealedGroups sync.Map
+
+type sealedGroupsResult struct {
+	groups []sealedGroup
+	err    error
+}
+
+// sealedGroupsOf returns the sealed groups of a schema.
+func sealedGroupsOf(sch *schema.Schema) ([]sealedGroup, error) {
+	if cached, ok := sealedGroups.Load(sch); ok {
+		result := cached.(sealedGroupsResult)
+		return result.groups, result.err
+	}
+
+	groups, err := parseSealedGroups(sch)
+	sealedGroups.Store(sch, sealedGroupsResult{groups: groups, err: err})
+	return groups, err
+}
+
+func parseSealedGroups(sch *schema.Schema) ([]sealedGroup, error) {
+	var groups []sealedGroup
+	index := map[string]int{}
+
+	for _, field := range sch.Fields {
+		name, ok := tagSettings(field)["group"]
+		if !ok {
+			continue
+		}
+		if field.DBName != "" {
+			return nil, fmt.Errorf("%w: field %s of group %s must be tagged with `gorm:\"-\"`", ErrInvalidGroup, field.Name, name)
+		}
+		if wrapsPlaintext(field.IndirectFieldType) {
+			return nil, fmt.Errorf("%w: field %s of group %s cannot be a Secret or Encrypted field", ErrInvalidGroup, field.Name, name)
+		}
+
+		i, ok := index[name]
+		if !ok {
+			column := sch.LookUpField(name)
+			if column == nil || !isEncrypted(column) {
+				return nil, fmt.Errorf("%w: group %s must be stored in an encrypted field with that name", ErrInvalidGroup, name)
+			}
+			if kind := column.FieldType.Kind(); kind != reflect.String && (kind != reflect.Slice || column.FieldType.Elem().Kind() != reflect.Uint8) {
+				return nil, fmt.Errorf("%w: group %s must be stored in a string or []byte field", ErrInvalidGroup, name)
+			}
+			i = len(groups)
+			index[name] = i
+			groups = append(groups, sealedGroup{column: column})
+		}
+		groups[i].members = append(groups[i].members, field)
+	}
+	return groups, nil
+}
+
+// wrapsPlaintext returns whether the values of type t wrap their plaintext, like Secret and Encrypted, which do not serialize it as JSON.
+func wrapsPlaintext(t reflect.Type) bool {
+	for _, wrapper := range []reflect.Type{reflect.TypeOf((*secretValue)(nil)).Elem(), reflect.TypeOf((*lazyValue)(nil)).Elem()} {
+		if t.Implements(wrapper) || reflect.PtrTo(t).Implements(wrapper) {
+			return true
+		}
+	}
+	return false
+}
+
+// seal serializes the members of the group held by the addressable struct v into its column.
+func (g sealedGroup) seal(v reflect.Value) error {
+	values := make(map[string]interface{}, len(g.members))
+	for _, member := range g.members {
+		if fv, ok := fieldByIndex(v, member.StructField.Index); ok {
+			values[member.Name] = fv.Interface()
+		}
+	}
+
+	sealed, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("sealing group %s: %w", g.column.Name, err)
+	}
+
+	column, _ := fieldByIndex(v, g.column.StructField.Index)
+	if column.Kind() == reflect.String {
+		column.SetString(string(sealed))
+	} else {
+		column.SetBytes(sealed)
+	}
+	return nil
+}
+
+// unseal deserializes the members of the group from its column in the addressable struct v. Groups whose column is empty, e.g. because it was not
+// selected or not decrypted, are left as they are.
+func (g sealedGroup) unseal(v reflect.Value) error {
+	column, ok := fieldByIndex(v, g.column.StructField.Index)
+	if !ok || column.Len() == 0 {
+		return nil
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(column.Convert(reflect.TypeOf("")).String()), &values); err != nil {
+		return fmt.Errorf("unsealing group %s: %w", g.column.Name, err)
+	}
+
+	for _, member := range g.members {
+		value, ok := values[member.Name]
+		if !ok {
+			continue
+		}
+		fv, ok := fieldByIndex(v, member.StructField.Index)
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(value, fv.Addr().Interface()); err != nil {
+			return fmt.Errorf("unsealing field %s of group %s: %w", member.Name, g.column.Name, err)
+		}
+	}
+	return nil
+}
+
+// sealGroups seals the groups of the models written by the statement. Nothing is sealed under WithoutEncryption, so that the columns copied
+// as-is are not overwritten. Updates that do not write the field storing a group leave it as it is, and fail with ErrPartialGroupUpdate if they
+// set any of its members.
+func (p *Plugin) sealGroups(db *gorm.DB, update bool) {
+	if isWithoutEncryption(db.Statement.Context) {
+		return
+	}
+
+	var columns map[string]bool
+	if update {
+		columns, _ = db.Statement.SelectAndOmitColumns(false, true)
+	}
+	p.forEachGroup(db, reflect.ValueOf(db.Statement.Dest), func(group sealedGroup, v reflect.Value, _ int) error {
+		// The fields omitted by the update are left as they are.
+		if written, ok := columns[group.column.DBName]; update && !written {
+			if !ok && !group.isZero(v) {
+				return fmt.Errorf("%w: group %s is only written by updates of all the fields of the model", ErrPartialGroupUpdate, group.column.Name)
+			}
+			return nil
+		}
+		return group.seal(v)
+	})
+}
+
+// isZero returns whether all the members of the group held by the addressable struct v are zero.
+func (g sealedGroup) isZero(v reflect.Value) bool {
+	for _, member := range g.members {
+		if fv, ok := fieldByIndex(v, member.StructField.Index); ok && !fv.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// unsealGroups unseals the groups of the models read by the statement. Nothing is unsealed under WithoutDecryption, and the columns withheld
+// by DecryptOnly or according to the decryption error policy are left as they are, since they do not hold the sealed group.
+func (p *Plugin) unsealGroups(db *gorm.DB) {
+	if isWithoutDecryption(db.Statement.Context) {
+		return
+	}
+	scope, ok := statementScopeFromContext(db.Statement.Context)
+	p.forEachGroup(db, db.Statement.ReflectValue, func(group sealedGroup, v reflect.Value, row int) error {
+		if ok && scope.undecrypted(group.column, row) {
+			return nil
+		}
+		return group.unseal(v)
+	})
+}
+
+// forEachGroup calls fn for the sealed groups of each addressable struct held by v, if they are of the schema of the statement, along with the
+// index of the struct among them, which is the row of a query.
+func (p *Plugin) forEachGroup(db *gorm.DB, v reflect.Value, fn func(sealedGroup, reflect.Value, int) error) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+
+	groups, err := sealedGroupsOf(db.Statement.Schema)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	if len(groups) == 0 {
+		return
+	}
+
+	row := 0
+	var visit func(v reflect.Value) error
+	visit = func(v reflect.Value) error {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			if !v.IsNil() {
+				return visit(v.Elem())
+			}
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < v.Len(); i++ {
+				if err := visit(v.Index(i)); err != nil {
+					return err
+				}
+			}
+		case reflect.Struct:
+			if v.Type() != db.Statement.Schema.ModelType || !v.CanAddr() {
+				return nil
+			}
+			for _, group := range groups {
+				if err := fn(group, v, row); err != nil {
+					return err
+				}
+			}
+			row++
+		}
+		return nil
+	}
+	if err := visit(v); err != nil {
+		_ = db.AddError(err)
+	}
+}
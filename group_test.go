@@ -0,0 +1,335 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type PersonGroup struct {
+	ID        int
+	FirstName string
+	Email     string    `gorm:"-" d1:"group=profile"`
+	Phone     string    `gorm:"-" d1:"group=profile"`
+	Birthday  time.Time `gorm:"-" d1:"group=profile"`
+	Age       int       `gorm:"-" d1:"group=profile"`
+	Profile   string    `gorm:"serializer:D1"`
+	Notes     []byte    `gorm:"-" d1:"group=secrets"`
+	Secrets   []byte    `gorm:"serializer:D1"`
+	Accounts  []AccountGroup
+}
+
+type AccountGroup struct {
+	ID            int
+	PersonGroupID int
+	Number        string `gorm:"-" d1:"group=sealed"`
+	Sealed        []byte `gorm:"serializer:D1"`
+}
+
+type countingCryptor struct {
+	slowCryptor
+	encrypts int
+}
+
+func (c *countingCryptor) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	c.encrypts++
+	return c.slowCryptor.Encrypt(ctx, plaintext)
+}
+
+func TestSealedGroups(t *testing.T) {
+	cryptor := &countingCryptor{}
+	schema.RegisterSerializer("D1", NewD1Serializer(cryptor))
+
+	db := testutil.NewTestDB(t)
+	err := db.Use(NewPlugin())
+	assert.Nil(t, err)
+	err = db.AutoMigrate(&PersonGroup{}, &AccountGroup{})
+	assert.Nil(t, err)
+
+	// The group members are not columns
+	columns, err := db.Migrator().ColumnTypes(&PersonGroup{})
+	assert.Nil(t, err)
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name()
+	}
+	assert.ElementsMatch(t, []string{"id", "first_name", "profile", "secrets"}, names)
+
+	birthday := time.Date(1958, 8, 29, 0, 0, 0, 0, time.UTC)
+	person := &PersonGroup{
+		ID:        1,
+		FirstName: "Michael",
+		Email:     "michael@example.com",
+		Phone:     "12345678",
+		Birthday:  birthday,
+		Age:       50,
+		Notes:     []byte("note"),
+		Accounts:  []AccountGroup{{ID: 1, Number: "DK001"}},
+	}
+	err = db.Create(person).Error
+	assert.Nil(t, err)
+
+	// A row costs one encryption per group
+	assert.Equal(t, 3, cryptor.encrypts)
+
+	var raw struct {
+		Profile string
+		Secrets []byte
+	}
+	err = db.Table("person_groups").First(&raw).Error
+	assert.Nil(t, err)
+	stored, err := base64.StdEncoding.DecodeString(raw.Profile)
+	assert.Nil(t, err)
+	var profile map[string]interface{}
+	err = json.Unmarshal(stored[len("encrypted:"):], &profile)
+	assert.Nil(t, err)
+	assert.Equal(t, "michael@example.com", profile["Email"])
+
+	found := &PersonGroup{}
+	err = db.Preload("Accounts").First(found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "michael@example.com", found.Email)
+	assert.Equal(t, "12345678", found.Phone)
+	assert.True(t, birthday.Equal(found.Birthday))
+	assert.Equal(t, 50, found.Age)
+	assert.Equal(t, []byte("note"), found.Notes)
+	assert.Equal(t, "DK001", found.Accounts[0].Number)
+
+	// Updates seal the whole group again
+	found.Phone = "87654321"
+	err = db.Save(found).Error
+	assert.Nil(t, err)
+
+	var people []PersonGroup
+	err = db.Find(&people).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "michael@example.com", people[0].Email)
+	assert.Equal(t, "87654321", people[0].Phone)
+}
+
+func TestSealedGroupsInvalid(t *testing.T) {
+	type PersonColumnMember struct {
+		ID      int
+		Email   string `d1:"group=profile"`
+		Profile string `gorm:"serializer:D1"`
+	}
+
+	type PersonUnencryptedGroup struct {
+		ID      int
+		Email   string `gorm:"-" d1:"group=profile"`
+		Profile string
+	}
+
+	type PersonSecretMember struct {
+		ID      int
+		Phone   Secret[string] `gorm:"-" d1:"group=profile"`
+		Profile string         `gorm:"serializer:D1"`
+	}
+
+	type PersonEncryptedMember struct {
+		ID      int
+		Phone   Encrypted[string] `gorm:"-" d1:"group=profile"`
+		Profile string            `gorm:"serializer:D1"`
+	}
+
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	db := testutil.NewTestDB(t)
+	err := db.Use(NewPlugin())
+	assert.Nil(t, err)
+
+	for _, model := range []interface{}{&PersonColumnMember{}, &PersonUnencryptedGroup{}, &PersonSecretMember{}, &PersonEncryptedMember{}} {
+		err = db.AutoMigrate(model)
+		assert.Nil(t, err)
+		err = db.Create(model).Error
+		assert.ErrorIs(t, err, ErrInvalidGroup)
+		err = db.Find(model).Error
+		assert.ErrorIs(t, err, ErrInvalidGroup)
+	}
+}
+
+// denyingCryptor refuses to decrypt the values that contain "denied".
+type denyingCryptor struct {
+	slowCryptor
+}
+
+func (c denyingCryptor) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if bytes.Contains(ciphertext, []byte("denied")) {
+		return nil, status.Error(codes.PermissionDenied, "denied")
+	}
+	return c.slowCryptor.Decrypt(ctx, ciphertext)
+}
+
+func newGroupTestDB(t *testing.T) *gorm.DB {
+	db := testutil.NewTestDB(t)
+	err := db.Use(NewPlugin())
+	assert.Nil(t, err)
+	err = db.AutoMigrate(&PersonGroup{}, &AccountGroup{})
+	assert.Nil(t, err)
+	return db
+}
+
+func TestSealedGroupsCopy(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+	source := newGroupTestDB(t)
+	destination := newGroupTestDB(t)
+
+	err := source.Create(&PersonGroup{ID: 1, FirstName: "Michael", Email: "michael@example.com", Notes: []byte("note")}).Error
+	assert.Nil(t, err)
+
+	// The groups are copied sealed
+	ctx := context.Background()
+	var people []PersonGroup
+	err = source.WithContext(WithoutDecryption(ctx)).Find(&people).Error
+	assert.Nil(t, err)
+	assert.Empty(t, people[0].Email)
+	assert.NotEmpty(t, people[0].Profile)
+
+	err = destination.WithContext(WithoutEncryption(ctx)).Create(&people).Error
+	assert.Nil(t, err)
+
+	var sourceRaw, destinationRaw []map[string]interface{}
+	err = source.Table("person_groups").Find(&sourceRaw).Error
+	assert.Nil(t, err)
+	err = destination.Table("person_groups").Find(&destinationRaw).Error
+	assert.Nil(t, err)
+	assert.Equal(t, sourceRaw, destinationRaw)
+
+	// The copy can be unsealed as usual
+	found := &PersonGroup{}
+	err = destination.First(found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "michael@example.com", found.Email)
+	assert.Equal(t, []byte("note"), found.Notes)
+}
+
+func TestSealedGroupsDecryptErrorPolicy(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(denyingCryptor{}))
+	db := newGroupTestDB(t)
+
+	err := db.Create(&[]PersonGroup{
+		{ID: 1, FirstName: "Michael", Email: "michael@example.com", Notes: []byte("note")},
+		{ID: 2, FirstName: "Denise", Email: "denied@example.com", Notes: []byte("note")},
+	}).Error
+	assert.Nil(t, err)
+
+	for _, policy := range []DecryptErrorPolicy{DecryptErrorZero, DecryptErrorMask} {
+		var people []PersonGroup
+		tx := db.Set(DecryptErrorPolicySetting, policy).Order("id").Find(&people)
+		assert.Nil(t, tx.Error)
+		assert.Len(t, DecryptErrors(tx), 1)
+		assert.Equal(t, "michael@example.com", people[0].Email)
+		assert.Empty(t, people[1].Email)
+		assert.Equal(t, []byte("note"), people[1].Notes)
+	}
+
+	var people []PersonGroup
+	tx := db.Set(DecryptErrorPolicySetting, DecryptErrorMask).Order("id").Find(&people)
+	assert.Nil(t, tx.Error)
+	assert.Equal(t, "[REDACTED]", people[1].Profile)
+}
+
+func TestSealedGroupsDecryptOnly(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+	db := newGroupTestDB(t)
+
+	err := db.Create(&PersonGroup{ID: 1, FirstName: "Michael", Email: "michael@example.com", Notes: []byte("note")}).Error
+	assert.Nil(t, err)
+
+	// The withheld groups are left sealed until revealed
+	found := &PersonGroup{}
+	tx := db.WithContext(DecryptOnly(context.Background(), "Secrets")).First(found, 1)
+	assert.Nil(t, tx.Error)
+	assert.Empty(t, found.Email)
+	assert.Empty(t, found.Profile)
+	assert.Equal(t, []byte("note"), found.Notes)
+
+	err = RevealField(context.Background(), tx, found, "Profile")
+	assert.Nil(t, err)
+	assert.Contains(t, found.Profile, "michael@example.com")
+}
+
+func TestSealedGroupsPartialUpdate(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+	db := newGroupTestDB(t)
+
+	err := db.Create(&PersonGroup{ID: 1, FirstName: "Michael", Email: "michael@example.com", Phone: "12345678"}).Error
+	assert.Nil(t, err)
+
+	// Partial updates do not clear the members they do not set
+	err = db.Model(&PersonGroup{ID: 1}).Updates(&PersonGroup{Email: "mike@example.com"}).Error
+	assert.ErrorIs(t, err, ErrPartialGroupUpdate)
+	err = db.Model(&PersonGroup{ID: 1}).Updates(&PersonGroup{FirstName: "Mike"}).Error
+	assert.Nil(t, err)
+
+	found := &PersonGroup{}
+	err = db.First(found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "Mike", found.FirstName)
+	assert.Equal(t, "michael@example.com", found.Email)
+	assert.Equal(t, "12345678", found.Phone)
+
+	// Updates of all the fields seal the whole group again
+	found.Email = "mike@example.com"
+	err = db.Select("*").Updates(found).Error
+	assert.Nil(t, err)
+
+	found = &PersonGroup{}
+	err = db.First(found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "mike@example.com", found.Email)
+	assert.Equal(t, "12345678", found.Phone)
+}
+
+type PersonGroupFound struct {
+	ID      int
+	Email   string `gorm:"-" d1:"group=profile"`
+	Profile string `gorm:"serializer:D1"`
+	found   string
+}
+
+func (p *PersonGroupFound) AfterFind(*gorm.DB) error {
+	p.found = p.Email
+	return nil
+}
+
+func TestSealedGroupsAfterFind(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+	db := newGroupTestDB(t)
+	err := db.AutoMigrate(&PersonGroupFound{})
+	assert.Nil(t, err)
+
+	err = db.Create(&PersonGroupFound{ID: 1, Email: "michael@example.com"}).Error
+	assert.Nil(t, err)
+
+	// The groups are unsealed before the AfterFind hooks
+	found := &PersonGroupFound{}
+	err = db.First(found, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "michael@example.com", found.found)
+}
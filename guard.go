@@ -0,0 +1,194 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// ErrPlaintextWrite is returned when a statement writes a value to an encrypted column without going through the D1Serializer, e.g. with
+// Update("column", value), Updates(map), UpdateColumn, gorm.Expr or Create from a map, and the value cannot or may not be encrypted.
+var ErrPlaintextWrite = fmt.Errorf("plaintext write to an encrypted column")
+
+// PlaintextWritePolicy determines how the Plugin handles values written to encrypted columns without going through the D1Serializer.
+type PlaintextWritePolicy int
+
+const (
+	// PlaintextWriteEncrypt encrypts the values with the D1Serializer of the column. SQL expressions and subqueries, which cannot be encrypted, are
+	// rejected with ErrPlaintextWrite. This is the default policy.
+	PlaintextWriteEncrypt PlaintextWritePolicy = iota
+	// PlaintextWriteReject rejects the statement with ErrPlaintextWrite.
+	PlaintextWriteReject
+)
+
+// writtenValue is a value encrypted by the Plugin before being written to an encrypted column, which gorm also assigns to the model.
+type writtenValue struct {
+	field     *schema.Field
+	plaintext interface{}
+	stored    interface{}
+}
+
+// guardedValue wraps the ciphertext of a value encrypted by the Plugin, so that it is redacted from the statements logged by the Logger like the
+// values encrypted by the D1Serializer.
+type guardedValue struct {
+	stored interface{}
+}
+
+// Value returns the ciphertext to be written to the database.
+func (v guardedValue) Value() (driver.Value, error) {
+	return v.stored, nil
+}
+
+// guardWrites encrypts or rejects the values written to encrypted columns by the map destination of the statement and by its SET and ON CONFLICT
+// clauses. The destination and clauses are replaced by copies, so that the values provided by the caller are left untouched.
+func (p *Plugin) guardWrites(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil || isWithoutEncryption(db.Statement.Context) {
+		return
+	}
+
+	switch dest := db.Statement.Dest.(type) {
+	case map[string]interface{}:
+		db.Statement.Dest = p.guardMap(db, dest)
+	case *map[string]interface{}:
+		db.Statement.Dest = p.guardMap(db, *dest)
+	case []map[string]interface{}:
+		db.Statement.Dest = p.guardMaps(db, dest)
+	case *[]map[string]interface{}:
+		db.Statement.Dest = p.guardMaps(db, *dest)
+	}
+
+	if c, ok := db.Statement.Clauses["SET"]; ok {
+		if set, ok := c.Expression.(clause.Set); ok {
+			c.Expression = p.guardSet(db, set)
+			db.Statement.Clauses["SET"] = c
+		}
+	}
+	if c, ok := db.Statement.Clauses["ON CONFLICT"]; ok {
+		if onConflict, ok := c.Expression.(clause.OnConflict); ok {
+			onConflict.DoUpdates = p.guardSet(db, onConflict.DoUpdates)
+			c.Expression = onConflict
+			db.Statement.Clauses["ON CONFLICT"] = c
+		}
+	}
+}
+
+func (p *Plugin) guardMaps(db *gorm.DB, values []map[string]interface{}) []map[string]interface{} {
+	guarded := make([]map[string]interface{}, len(values))
+	for i, value := range values {
+		guarded[i] = p.guardMap(db, value)
+	}
+	return guarded
+}
+
+func (p *Plugin) guardMap(db *gorm.DB, values map[string]interface{}) map[string]interface{} {
+	guarded := make(map[string]interface{}, len(values))
+	for column, value := range values {
+		if field := db.Statement.Schema.LookUpField(column); field != nil && isEncrypted(field) {
+			value = p.guardValue(db, field, value)
+		}
+		guarded[column] = value
+	}
+	return guarded
+}
+
+func (p *Plugin) guardSet(db *gorm.DB, set clause.Set) clause.Set {
+	if len(set) == 0 {
+		return set
+	}
+
+	guarded := make(clause.Set, len(set))
+	for i, assignment := range set {
+		if field := db.Statement.Schema.LookUpField(assignment.Column.Name); field != nil && isEncrypted(field) {
+			assignment.Value = p.guardValue(db, field, assignment.Value)
+		}
+		guarded[i] = assignment
+	}
+	return guarded
+}
+
+// guardValue returns the value to be written to an encrypted field. Errors are added to the statement.
+func (p *Plugin) guardValue(db *gorm.DB, field *schema.Field, value interface{}) interface{} {
+	switch value.(type) {
+	case nil, clause.Column:
+		// NULL, or the value of another column, e.g. excluded.column when upserting.
+		return value
+	case clause.Expression, *gorm.DB:
+		_ = db.AddError(fmt.Errorf("%w: column %s is set with an SQL expression", ErrPlaintextWrite, field.DBName))
+		return value
+	}
+
+	if p.opts.plaintextWrites == PlaintextWriteReject {
+		_ = db.AddError(fmt.Errorf("%w: column %s", ErrPlaintextWrite, field.DBName))
+		return value
+	}
+
+	dst := db.Statement.ReflectValue
+	if dst.Kind() != reflect.Struct {
+		dst = reflect.Value{}
+	}
+	stored, err := field.Serializer.Value(db.Statement.Context, field, dst, value)
+	if err != nil {
+		_ = db.AddError(err)
+		return value
+	}
+
+	if scope, ok := statementScopeFromContext(db.Statement.Context); ok {
+		scope.mu.Lock()
+		scope.written = append(scope.written, writtenValue{field: field, plaintext: value, stored: stored})
+		scope.mu.Unlock()
+	}
+	return guardedValue{stored: stored}
+}
+
+// restoreWrites sets back the plaintext of the values encrypted by guardWrites in the model, to which gorm assigns the values it writes.
+func (p *Plugin) restoreWrites(db *gorm.DB) {
+	scope, ok := statementScopeFromContext(db.Statement.Context)
+	if !ok || scope.statement != db.Statement {
+		return
+	}
+
+	scope.mu.Lock()
+	written := scope.written
+	scope.written = nil
+	scope.mu.Unlock()
+
+	rv := db.Statement.ReflectValue
+	for _, w := range written {
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < rv.Len(); i++ {
+				restoreWrite(db, w, rv.Index(i))
+			}
+		case reflect.Struct:
+			restoreWrite(db, w, rv)
+		}
+	}
+}
+
+func restoreWrite(db *gorm.DB, w writtenValue, model reflect.Value) {
+	fv := w.field.ReflectValueOf(db.Statement.Context, reflect.Indirect(model))
+	if !fv.IsValid() || !fv.CanSet() || !reflect.DeepEqual(fv.Interface(), w.stored) {
+		return
+	}
+	if err := w.field.Set(db.Statement.Context, reflect.Indirect(model), w.plaintext); err != nil {
+		_ = db.AddError(err)
+	}
+}
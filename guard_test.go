@@ -0,0 +1,135 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type PersonGuard struct {
+	ID        int
+	FirstName string
+	LastName  string `gorm:"serializer:D1"`
+	Notes     []byte `gorm:"serializer:D1"`
+}
+
+type PersonGuardRaw struct {
+	ID        int
+	FirstName string
+	LastName  string
+	Notes     []byte
+}
+
+func newGuardTestDB(t *testing.T, opts ...PluginOption) *gorm.DB {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	db := testutil.NewTestDB(t)
+	err := db.Use(NewPlugin(opts...))
+	assert.Nil(t, err)
+	err = db.AutoMigrate(&PersonGuard{})
+	assert.Nil(t, err)
+
+	err = db.Create(&PersonGuard{1, "John", "Doe", []byte("note")}).Error
+	assert.Nil(t, err)
+	return db
+}
+
+func storedPersonGuard(t *testing.T, db *gorm.DB, id int) PersonGuardRaw {
+	var raw PersonGuardRaw
+	err := db.Table("person_guards").First(&raw, id).Error
+	assert.Nil(t, err)
+	return raw
+}
+
+func encryptedLastName(lastName string) string {
+	return base64.StdEncoding.EncodeToString([]byte("encrypted:" + lastName))
+}
+
+func TestGuardEncryptsPlaintextWrites(t *testing.T) {
+	db := newGuardTestDB(t)
+
+	person := &PersonGuard{ID: 1}
+	err := db.Model(person).Update("last_name", "Roe").Error
+	assert.Nil(t, err)
+	assert.Equal(t, "Roe", person.LastName)
+	assert.Equal(t, encryptedLastName("Roe"), storedPersonGuard(t, db, 1).LastName)
+
+	values := map[string]interface{}{"LastName": "Poe", "notes": []byte("other")}
+	err = db.Model(person).Updates(values).Error
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"LastName": "Poe", "notes": []byte("other")}, values)
+	assert.Equal(t, PersonGuardRaw{1, "John", encryptedLastName("Poe"), []byte("encrypted:other")}, storedPersonGuard(t, db, 1))
+
+	err = db.Model(person).UpdateColumn("last_name", "Moe").Error
+	assert.Nil(t, err)
+	assert.Equal(t, encryptedLastName("Moe"), storedPersonGuard(t, db, 1).LastName)
+
+	err = db.Model(&PersonGuard{}).Create(map[string]interface{}{"id": 2, "first_name": "Jane", "last_name": "Doe"}).Error
+	assert.Nil(t, err)
+	assert.Equal(t, encryptedLastName("Doe"), storedPersonGuard(t, db, 2).LastName)
+
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"last_name": "Zoe"}),
+	}).Create(&PersonGuard{ID: 2, LastName: "Roe"}).Error
+	assert.Nil(t, err)
+	assert.Equal(t, encryptedLastName("Zoe"), storedPersonGuard(t, db, 2).LastName)
+
+	// The values are decrypted as usual
+	err = db.First(person, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, PersonGuard{1, "John", "Moe", []byte("other")}, *person)
+
+	// Values of unencrypted columns and NULL are written as is
+	err = db.Model(person).Updates(map[string]interface{}{"first_name": "Jim", "notes": nil}).Error
+	assert.Nil(t, err)
+	assert.Equal(t, PersonGuardRaw{1, "Jim", encryptedLastName("Moe"), nil}, storedPersonGuard(t, db, 1))
+}
+
+func TestGuardRejectsExpressions(t *testing.T) {
+	db := newGuardTestDB(t)
+
+	err := db.Model(&PersonGuard{ID: 1}).Update("last_name", gorm.Expr("first_name")).Error
+	assert.ErrorIs(t, err, ErrPlaintextWrite)
+
+	err = db.Model(&PersonGuard{ID: 1}).Update("last_name", db.Model(&PersonGuard{}).Select("first_name").Where("id = 1")).Error
+	assert.ErrorIs(t, err, ErrPlaintextWrite)
+	assert.Equal(t, encryptedLastName("Doe"), storedPersonGuard(t, db, 1).LastName)
+}
+
+func TestGuardRejectsPlaintextWrites(t *testing.T) {
+	db := newGuardTestDB(t, WithPlaintextWritePolicy(PlaintextWriteReject))
+
+	err := db.Model(&PersonGuard{ID: 1}).Update("last_name", "Roe").Error
+	assert.ErrorIs(t, err, ErrPlaintextWrite)
+
+	err = db.Model(&PersonGuard{}).Create(map[string]interface{}{"id": 2, "last_name": "Roe"}).Error
+	assert.ErrorIs(t, err, ErrPlaintextWrite)
+
+	// Writes through the serializer and to unencrypted columns are allowed
+	err = db.Model(&PersonGuard{ID: 1}).Updates(&PersonGuard{LastName: "Roe"}).Error
+	assert.Nil(t, err)
+	err = db.Model(&PersonGuard{ID: 1}).Update("first_name", "Jim").Error
+	assert.Nil(t, err)
+	assert.Equal(t, PersonGuardRaw{1, "Jim", encryptedLastName("Roe"), []byte("encrypted:note")}, storedPersonGuard(t, db, 1))
+}
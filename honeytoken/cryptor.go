@@ -0,0 +1,106 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package honeytoken provides a Cryptor that raises alerts when honeytokens, encrypted values planted in the database that are never legitimately
+// read, are decrypted.
+package honeytoken
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// Alert describes the decryption of a honeytoken.
+type Alert struct {
+	Token Token
+	// Identity is the identity of the caller, as returned by the identity function of the Cryptor.
+	Identity string
+	// Table, Column and PrimaryKey identify the decrypted field. They are empty if the Cryptor was not called by the D1Serializer.
+	Table      string
+	Column     string
+	PrimaryKey string
+	Timestamp  time.Time
+	// Stack is the stack trace of the goroutine that decrypted the honeytoken.
+	Stack string
+}
+
+type plantCtxKey struct{}
+
+// Plant returns a copy of ctx with which all the values encrypted by a Cryptor are registered as honeytokens, e.g.
+// db.WithContext(honeytoken.Plant(ctx)).Create(&canary).
+func Plant(ctx context.Context) context.Context {
+	return context.WithValue(ctx, plantCtxKey{}, true)
+}
+
+func isPlanting(ctx context.Context) bool {
+	planting, _ := ctx.Value(plantCtxKey{}).(bool)
+	return planting
+}
+
+// Cryptor is an implementation of the Cryptor interface that calls an alert function whenever a honeytoken is decrypted. The decryption itself is
+// performed as usual, so that the caller is not warned.
+type Cryptor struct {
+	cryptor  crypto.Cryptor
+	registry Registry
+	alert    func(ctx context.Context, alert Alert)
+	identity func(ctx context.Context) string
+}
+
+// NewCryptor creates a new Cryptor that watches the decryptions of the provided Cryptor for the honeytokens in the registry.
+func NewCryptor(cryptor crypto.Cryptor, registry Registry, alert func(ctx context.Context, alert Alert), opts ...Option) *Cryptor {
+	o := defaultOptions()
+	o.apply(opts...)
+
+	return &Cryptor{cryptor: cryptor, registry: registry, alert: alert, identity: o.identity}
+}
+
+// Encrypt calls Encrypt on the wrapped Cryptor. If the context was created with Plant, the ciphertext is registered as a honeytoken.
+func (c *Cryptor) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	ciphertext, err := c.cryptor.Encrypt(ctx, plaintext)
+	if err != nil || !isPlanting(ctx) {
+		return ciphertext, err
+	}
+
+	token := Token{Digest: Digest(ciphertext)}
+	if id, ok := objectID(ciphertext); ok {
+		token.ObjectID = id
+	}
+	if err := c.registry.Register(token); err != nil {
+		return nil, err
+	}
+	return ciphertext, nil
+}
+
+// Decrypt calls Decrypt on the wrapped Cryptor, after calling the alert function if the ciphertext is a honeytoken.
+func (c *Cryptor) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if token, ok := c.registry.Lookup(ciphertext); ok {
+		alert := Alert{
+			Token:     token,
+			Identity:  c.identity(ctx),
+			Timestamp: time.Now(),
+			Stack:     string(debug.Stack()),
+		}
+		if info, ok := crypto.FieldInfoFromContext(ctx); ok {
+			alert.Table = info.Table
+			alert.Column = info.Column
+			alert.PrimaryKey = info.PrimaryKey
+		}
+		c.alert(ctx, alert)
+	}
+
+	return c.cryptor.Decrypt(ctx, ciphertext)
+}
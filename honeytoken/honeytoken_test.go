@@ -0,0 +1,102 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package honeytoken
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm/schema"
+
+	d1gorm "github.com/cybercryptio/d1-gorm"
+	"github.com/cybercryptio/d1-gorm/crypto"
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+func TestHoneytokenAlert(t *testing.T) {
+	type Person struct {
+		ID  int
+		SSN string `gorm:"serializer:D1"`
+	}
+
+	cryptorMock := &testutil.CryptorMock{}
+	cryptorMock.On("Encrypt", mock.Anything, []byte("123-45-6789")).Once().Return([]byte("encrypted-real"), nil)
+	cryptorMock.On("Encrypt", mock.Anything, []byte("000-00-0000")).Once().Return([]byte("encrypted-canary"), nil)
+	cryptorMock.On("Decrypt", mock.Anything, []byte("encrypted-real")).Return([]byte("123-45-6789"), nil)
+	cryptorMock.On("Decrypt", mock.Anything, []byte("encrypted-canary")).Return([]byte("000-00-0000"), nil)
+
+	var alerts []Alert
+	registry := NewMemoryRegistry()
+	cryptor := NewCryptor(cryptorMock, registry, func(ctx context.Context, alert Alert) {
+		alerts = append(alerts, alert)
+	})
+	schema.RegisterSerializer("D1", d1gorm.NewD1Serializer(cryptor))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&Person{})
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	err = db.WithContext(ctx).Create(&Person{ID: 1, SSN: "123-45-6789"}).Error
+	assert.Nil(t, err)
+	err = db.WithContext(Plant(ctx)).Create(&Person{ID: 2, SSN: "000-00-0000"}).Error
+	assert.Nil(t, err)
+
+	assert.Equal(t, []Token{{Digest: Digest([]byte("encrypted-canary"))}}, registry.Tokens())
+
+	// Reading the real person does not raise an alert
+	err = db.First(&Person{}, 1).Error
+	assert.Nil(t, err)
+	assert.Empty(t, alerts)
+
+	// Reading all the persons decrypts the honeytoken, which raises an alert but returns the value as usual
+	var people []Person
+	err = db.WithContext(crypto.ContextWithIdentity(ctx, "mallory")).Find(&people).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []Person{{1, "123-45-6789"}, {2, "000-00-0000"}}, people)
+
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, Digest([]byte("encrypted-canary")), alerts[0].Token.Digest)
+	assert.Equal(t, "mallory", alerts[0].Identity)
+	assert.Equal(t, "people", alerts[0].Table)
+	assert.Equal(t, "ssn", alerts[0].Column)
+	assert.Equal(t, "2", alerts[0].PrimaryKey)
+	assert.Contains(t, alerts[0].Stack, "TestHoneytokenAlert")
+	cryptorMock.AssertExpectations(t)
+}
+
+func TestRegistryObjectID(t *testing.T) {
+	id := uuid.New().String()
+	registry := NewMemoryRegistry(Token{ObjectID: id})
+
+	token, ok := registry.Lookup(append([]byte(id), "ciphertext"...))
+	assert.True(t, ok)
+	assert.Equal(t, id, token.ObjectID)
+
+	// The compact form of the object ID matches the same token
+	compact := uuid.MustParse(id)
+	token, ok = registry.Lookup(append(append([]byte{crypto.CompactObjectIDMarker}, compact[:]...), "ciphertext"...))
+	assert.True(t, ok)
+	assert.Equal(t, id, token.ObjectID)
+
+	_, ok = registry.Lookup(append([]byte(uuid.New().String()), "ciphertext"...))
+	assert.False(t, ok)
+
+	_, ok = registry.Lookup([]byte("short"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,50 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package honeytoken
+
+import (
+	"context"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+type options struct {
+	identity func(ctx context.Context) string
+}
+
+// Option is used to configure optional settings for the honeytoken Cryptor.
+type Option func(*options)
+
+func defaultOptions() options {
+	return options{
+		identity: func(ctx context.Context) string {
+			identity, _ := crypto.IdentityFromContext(ctx)
+			return identity
+		},
+	}
+}
+
+func (o *options) apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithIdentityFunc sets the function used to extract the identity of the caller from the context. The default is crypto.IdentityFromContext.
+func WithIdentityFunc(identity func(ctx context.Context) string) Option {
+	return func(o *options) {
+		o.identity = identity
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package honeytoken
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// Token identifies a honeytoken, either by the D1 object ID of its ciphertext, or by the digest of its ciphertext, or both.
+type Token struct {
+	ObjectID string
+	Digest   string
+}
+
+// Registry holds the known honeytokens. Implementations must be safe for concurrent use.
+type Registry interface {
+	// Register adds a honeytoken to the registry.
+	Register(token Token) error
+	// Lookup returns the honeytoken matching the ciphertext, if any.
+	Lookup(ciphertext []byte) (Token, bool)
+}
+
+// Digest returns the digest of a ciphertext, as used to identify honeytokens.
+func Digest(ciphertext []byte) string {
+	digest := sha256.Sum256(ciphertext)
+	return hex.EncodeToString(digest[:])
+}
+
+// objectID returns the D1 object ID that prefixes a ciphertext produced by the D1Cryptor, in its textual form whether the ciphertext holds its
+// textual or compact form.
+func objectID(ciphertext []byte) (string, bool) {
+	id, _, err := crypto.ObjectID(ciphertext)
+	return id, err == nil
+}
+
+// MemoryRegistry is an implementation of the Registry interface that holds the honeytokens in memory. Applications are expected to register their
+// honeytokens at startup, e.g. from their configuration.
+type MemoryRegistry struct {
+	mu        sync.RWMutex
+	objectIDs map[string]Token
+	digests   map[string]Token
+}
+
+// NewMemoryRegistry creates a new MemoryRegistry holding the provided honeytokens.
+func NewMemoryRegistry(tokens ...Token) *MemoryRegistry {
+	r := &MemoryRegistry{objectIDs: map[string]Token{}, digests: map[string]Token{}}
+	for _, token := range tokens {
+		_ = r.Register(token)
+	}
+	return r
+}
+
+// Register adds a honeytoken to the registry.
+func (r *MemoryRegistry) Register(token Token) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if token.ObjectID != "" {
+		r.objectIDs[token.ObjectID] = token
+	}
+	if token.Digest != "" {
+		r.digests[token.Digest] = token
+	}
+	return nil
+}
+
+// Lookup returns the honeytoken matching the ciphertext, if any.
+func (r *MemoryRegistry) Lookup(ciphertext []byte) (Token, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id, ok := objectID(ciphertext); ok {
+		if token, ok := r.objectIDs[id]; ok {
+			return token, true
+		}
+	}
+	token, ok := r.digests[Digest(ciphertext)]
+	return token, ok
+}
+
+// Tokens returns all the honeytokens in the registry, e.g. to persist them.
+func (r *MemoryRegistry) Tokens() []Token {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seen := map[Token]bool{}
+	tokens := make([]Token, 0, len(r.digests)+len(r.objectIDs))
+	for _, token := range r.objectIDs {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	for _, token := range r.digests {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
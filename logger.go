@@ -0,0 +1,146 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/logger"
+)
+
+// LoggerConfig holds the configuration of a Logger.
+type LoggerConfig struct {
+	// SlowCryptoThreshold is the total time spent encrypting and decrypting during a statement above which a warning is logged. A zero value
+	// disables the warning.
+	SlowCryptoThreshold time.Duration
+}
+
+// Logger is a gorm logger that wraps another logger, and adds to each traced statement the number of encryptions and decryptions performed by the
+// D1Serializer and the time spent on them. It warns about statements whose time spent in the Cryptor is above the SlowCryptoThreshold, and redacts
+// the encrypted values from the logged SQL. The Logger relies on the Plugin being registered with the database.
+type Logger struct {
+	logger.Interface
+	config LoggerConfig
+}
+
+// NewLogger creates a new Logger that wraps the provided logger. Loggers created with logger.New, such as logger.Default, report the caller of the
+// statement as gorm does, rather than the Logger.
+func NewLogger(l logger.Interface, config LoggerConfig) *Logger {
+	return &Logger{Interface: withCaller(l), config: config}
+}
+
+// withCaller returns a copy of a logger created with logger.New that reports the caller of the statement. Such loggers print the first frame outside
+// of gorm, which is the Logger, so they are recreated with a writer that replaces it. Other loggers are returned as they are.
+func withCaller(l logger.Interface) logger.Interface {
+	v := reflect.Indirect(reflect.ValueOf(l))
+	if v.Kind() != reflect.Struct || v.Type().PkgPath() != reflect.TypeOf(logger.Config{}).PkgPath() {
+		return l
+	}
+	writer, config := v.FieldByName("Writer"), v.FieldByName("Config")
+	if !writer.IsValid() || !config.IsValid() {
+		return l
+	}
+	w, ok := writer.Interface().(logger.Writer)
+	if !ok {
+		return l
+	}
+	if _, ok := w.(callerWriter); ok {
+		return l
+	}
+	c, ok := config.Interface().(logger.Config)
+	if !ok {
+		return l
+	}
+	return logger.New(callerWriter{Writer: w}, c)
+}
+
+// callerWriter is the writer of a logger created with logger.New, which replaces the file and line number printed first by the logger with those of
+// the caller of the statement.
+type callerWriter struct {
+	logger.Writer
+}
+
+// Printf prints a log line.
+func (w callerWriter) Printf(format string, args ...interface{}) {
+	if len(args) > 0 {
+		if _, ok := args[0].(string); ok {
+			args = append([]interface{}{fileWithLineNum()}, args[1:]...)
+		}
+	}
+	w.Writer.Printf(format, args...)
+}
+
+// d1PkgPath is the import path of this module.
+var d1PkgPath = reflect.TypeOf(Logger{}).PkgPath()
+
+// fileWithLineNum returns the file and line number of the first caller outside of gorm and of this module, not counting tests.
+func fileWithLineNum() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		internal := strings.HasPrefix(frame.Function, "gorm.io/") || strings.HasPrefix(frame.Function, d1PkgPath+".") ||
+			strings.HasPrefix(frame.Function, d1PkgPath+"/")
+		if !internal || strings.HasSuffix(frame.File, "_test.go") {
+			return frame.File + ":" + strconv.Itoa(frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// LogMode returns a copy of the Logger with the log level of the wrapped logger set to level.
+func (l *Logger) LogMode(level logger.LogLevel) logger.Interface {
+	return &Logger{Interface: l.Interface.LogMode(level), config: l.config}
+}
+
+// Trace is called by gorm after every statement and passes it to the wrapped logger.
+func (l *Logger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	scope, ok := statementScopeFromContext(ctx)
+	if !ok {
+		l.Interface.Trace(ctx, begin, fc, err)
+		return
+	}
+
+	scope.mu.Lock()
+	stats, explain := scope.stats, scope.explain
+	scope.mu.Unlock()
+
+	if explain == nil {
+		explain = fc
+	}
+	traced := func() (string, int64) {
+		sql, rows := explain()
+		if stats.Encrypts == 0 && stats.Decrypts == 0 {
+			return sql, rows
+		}
+		return fmt.Sprintf("%s /* d1: %d encrypts, %d decrypts, %.3fms */", sql, stats.Encrypts, stats.Decrypts,
+			float64(stats.Duration.Nanoseconds())/1e6), rows
+	}
+
+	if l.config.SlowCryptoThreshold != 0 && stats.Duration > l.config.SlowCryptoThreshold {
+		sql, rows := traced()
+		l.Interface.Warn(ctx, "SLOW CRYPTO >= %v\n[rows:%d] %s", l.config.SlowCryptoThreshold, rows, sql)
+	}
+
+	l.Interface.Trace(ctx, begin, traced, err)
+}
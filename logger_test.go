@@ -0,0 +1,168 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type slowCryptor struct {
+	delay time.Duration
+}
+
+func (c slowCryptor) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	time.Sleep(c.delay)
+	return append([]byte("encrypted:"), plaintext...), nil
+}
+
+func (c slowCryptor) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	time.Sleep(c.delay)
+	return bytes.TrimPrefix(ciphertext, []byte("encrypted:")), nil
+}
+
+func newLoggedTestDB(t *testing.T, config LoggerConfig) (*gorm.DB, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	db := testutil.NewTestDB(t)
+	db.Logger = NewLogger(logger.New(log.New(buf, "", 0), logger.Config{LogLevel: logger.Info}), config)
+
+	err := db.Use(NewPlugin())
+	assert.Nil(t, err)
+	return db, buf
+}
+
+func TestLoggerStatementStats(t *testing.T) {
+	type PersonString struct {
+		ID        int
+		FirstName string
+		LastName  string `gorm:"serializer:D1"`
+	}
+
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	db, buf := newLoggedTestDB(t, LoggerConfig{})
+	err := db.AutoMigrate(&PersonString{})
+	assert.Nil(t, err)
+
+	buf.Reset()
+	err = db.Create(&[]PersonString{{1, "John", "Doe"}, {2, "Jane", "Doe"}}).Error
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "/* d1: 2 encrypts, 0 decrypts")
+	assert.Contains(t, buf.String(), redacted)
+	assert.NotContains(t, buf.String(), "Doe")
+	assert.NotContains(t, buf.String(), "encrypted:")
+
+	buf.Reset()
+	var people []PersonString
+	err = db.Find(&people).Error
+	assert.Nil(t, err)
+	assert.Len(t, people, 2)
+	assert.Contains(t, buf.String(), "/* d1: 0 encrypts, 2 decrypts")
+	assert.NotContains(t, buf.String(), "SLOW CRYPTO")
+
+	buf.Reset()
+	var count int64
+	err = db.Model(&PersonString{}).Count(&count).Error
+	assert.Nil(t, err)
+	assert.NotContains(t, buf.String(), "/* d1:")
+}
+
+func TestLoggerSlowCrypto(t *testing.T) {
+	type PersonString struct {
+		ID        int
+		FirstName string
+		LastName  string `gorm:"serializer:D1"`
+	}
+
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{delay: 10 * time.Millisecond}))
+
+	db, buf := newLoggedTestDB(t, LoggerConfig{SlowCryptoThreshold: 5 * time.Millisecond})
+	err := db.AutoMigrate(&PersonString{})
+	assert.Nil(t, err)
+
+	buf.Reset()
+	err = db.Create(&PersonString{1, "John", "Doe"}).Error
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "SLOW CRYPTO >= 5ms")
+	assert.NotContains(t, buf.String(), "Doe")
+
+	buf.Reset()
+	ctx := context.Background()
+	err = db.WithContext(ctx).First(&PersonString{}).Error
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "SLOW CRYPTO >= 5ms")
+}
+
+func TestLoggerRedactsGuardedWrites(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	db, buf := newLoggedTestDB(t, LoggerConfig{})
+	err := db.AutoMigrate(&PersonGuard{})
+	assert.Nil(t, err)
+
+	person := &PersonGuard{1, "John", "Doe", nil}
+	err = db.Create(person).Error
+	assert.Nil(t, err)
+
+	writes := []func() error{
+		func() error { return db.Model(person).Update("last_name", "Smith").Error },
+		func() error { return db.Model(person).Updates(map[string]interface{}{"last_name": "Smith"}).Error },
+		func() error {
+			return db.Model(&PersonGuard{}).Create(map[string]interface{}{"id": 2, "last_name": "Smith"}).Error
+		},
+	}
+	for _, write := range writes {
+		buf.Reset()
+		err = write()
+		assert.Nil(t, err)
+		assert.Contains(t, buf.String(), redacted)
+		assert.NotContains(t, buf.String(), "Smith")
+		assert.NotContains(t, buf.String(), encryptedLastName("Smith"))
+	}
+	assert.Equal(t, "Smith", person.LastName)
+}
+
+func TestLoggerCaller(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{delay: 10 * time.Millisecond}))
+
+	db, buf := newLoggedTestDB(t, LoggerConfig{SlowCryptoThreshold: 5 * time.Millisecond})
+	err := db.AutoMigrate(&PersonGuard{})
+	assert.Nil(t, err)
+
+	// Both the trace and the warning point at the statement
+	buf.Reset()
+	err = db.Create(&PersonGuard{1, "John", "Doe", nil}).Error
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "SLOW CRYPTO")
+	assert.Equal(t, 2, strings.Count(buf.String(), "logger_test.go:"))
+	assert.NotContains(t, buf.String(), "logger.go:")
+
+	// The log level can still be changed
+	buf.Reset()
+	err = db.Session(&gorm.Session{Logger: db.Logger.LogMode(logger.Silent)}).First(&PersonGuard{}).Error
+	assert.Nil(t, err)
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// Operation is the kind of operation performed by a Cryptor.
+type Operation string
+
+const (
+	// OperationEncrypt is the operation recorded for calls to Encrypt.
+	OperationEncrypt Operation = "encrypt"
+	// OperationDecrypt is the operation recorded for calls to Decrypt.
+	OperationDecrypt Operation = "decrypt"
+)
+
+// Observation describes a single call to a Cryptor.
+type Observation struct {
+	Operation Operation
+	// Table and Column identify the field being encrypted or decrypted. They are empty if the Cryptor was not called by the D1Serializer.
+	Table  string
+	Column string
+	// Code is the gRPC status code of the call. It is codes.OK if the call succeeded, and codes.Unknown for errors that do not originate from gRPC.
+	Code codes.Code
+	// Duration is the time spent in the wrapped Cryptor.
+	Duration time.Duration
+	// Bytes is the size of the input to the operation, i.e. the plaintext for encryptions and the ciphertext for decryptions.
+	Bytes int
+}
+
+// Sink receives the observations recorded by a Cryptor. Implementations must be safe for concurrent use.
+type Sink interface {
+	Observe(ctx context.Context, observation Observation)
+}
+
+// Cryptor is an implementation of the Cryptor interface that reports an Observation to a Sink for every call to the wrapped Cryptor.
+type Cryptor struct {
+	cryptor crypto.Cryptor
+	sink    Sink
+}
+
+// NewCryptor creates a new Cryptor that reports the calls to the provided Cryptor to the provided Sink.
+func NewCryptor(cryptor crypto.Cryptor, sink Sink) Cryptor {
+	return Cryptor{cryptor: cryptor, sink: sink}
+}
+
+// Encrypt calls Encrypt on the wrapped Cryptor and reports the call to the Sink.
+func (c Cryptor) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	start := time.Now()
+	ciphertext, err := c.cryptor.Encrypt(ctx, plaintext)
+	c.observe(ctx, OperationEncrypt, len(plaintext), time.Since(start), err)
+	return ciphertext, err
+}
+
+// Decrypt calls Decrypt on the wrapped Cryptor and reports the call to the Sink.
+func (c Cryptor) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	start := time.Now()
+	plaintext, err := c.cryptor.Decrypt(ctx, ciphertext)
+	c.observe(ctx, OperationDecrypt, len(ciphertext), time.Since(start), err)
+	return plaintext, err
+}
+
+func (c Cryptor) observe(ctx context.Context, operation Operation, size int, duration time.Duration, err error) {
+	observation := Observation{
+		Operation: operation,
+		Code:      status.Code(err),
+		Duration:  duration,
+		Bytes:     size,
+	}
+	if info, ok := crypto.FieldInfoFromContext(ctx); ok {
+		observation.Table = info.Table
+		observation.Column = info.Column
+	}
+	c.sink.Observe(ctx, observation)
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package metrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm/schema"
+
+	d1gorm "github.com/cybercryptio/d1-gorm"
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type sinkMock struct {
+	mu           sync.Mutex
+	observations []Observation
+}
+
+func (s *sinkMock) Observe(ctx context.Context, observation Observation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observations = append(s.observations, observation)
+}
+
+func TestCryptorObservations(t *testing.T) {
+	type Person struct {
+		FirstName string
+		LastName  string `gorm:"serializer:D1"`
+	}
+
+	firstName := "John"
+	lastName := "Doe"
+	encryptedLastName := "Doencrypt"
+
+	cryptor := &testutil.CryptorMock{}
+	cryptor.On("Encrypt", mock.Anything, []byte(lastName)).Once().Return([]byte(encryptedLastName), nil)
+	cryptor.On("Decrypt", mock.Anything, []byte(encryptedLastName)).Once().Return(nil, status.Error(codes.PermissionDenied, "denied"))
+
+	sink := &sinkMock{}
+	schema.RegisterSerializer("D1", d1gorm.NewD1Serializer(NewCryptor(cryptor, sink)))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&Person{})
+	assert.Nil(t, err)
+
+	err = db.Create(&Person{FirstName: firstName, LastName: lastName}).Error
+	assert.Nil(t, err)
+
+	p := &Person{}
+	err = db.Where("first_name = ?", firstName).First(p).Error
+	assert.NotNil(t, err)
+
+	assert.Len(t, sink.observations, 2)
+
+	encrypt := sink.observations[0]
+	assert.Equal(t, OperationEncrypt, encrypt.Operation)
+	assert.Equal(t, "people", encrypt.Table)
+	assert.Equal(t, "last_name", encrypt.Column)
+	assert.Equal(t, codes.OK, encrypt.Code)
+	assert.Equal(t, len(lastName), encrypt.Bytes)
+
+	decrypt := sink.observations[1]
+	assert.Equal(t, OperationDecrypt, decrypt.Operation)
+	assert.Equal(t, "people", decrypt.Table)
+	assert.Equal(t, "last_name", decrypt.Column)
+	assert.Equal(t, codes.PermissionDenied, decrypt.Code)
+	assert.Equal(t, len(encryptedLastName), decrypt.Bytes)
+
+	cryptor.AssertExpectations(t)
+}
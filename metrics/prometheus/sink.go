@@ -0,0 +1,85 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package prometheus provides a metrics.Sink that exports the observations recorded by a metrics.Cryptor as Prometheus metrics.
+package prometheus
+
+import (
+	"context"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cybercryptio/d1-gorm/metrics"
+)
+
+// Sink is an implementation of the metrics.Sink interface that exports the following metrics, all labeled by operation, table and column:
+//   - operations_total: the number of operations, additionally labeled by gRPC status code.
+//   - operation_duration_seconds: a histogram of the operation latencies.
+//   - operation_bytes_total: the number of bytes processed.
+//
+// Sink is a prometheus.Collector, and must be registered with a prometheus.Registerer for the metrics to be exported.
+type Sink struct {
+	operations *prom.CounterVec
+	duration   *prom.HistogramVec
+	bytes      *prom.CounterVec
+}
+
+var labels = []string{"operation", "table", "column"}
+
+// NewSink creates a new Sink.
+func NewSink(opts ...Option) *Sink {
+	o := defaultOptions()
+	o.apply(opts...)
+
+	return &Sink{
+		operations: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: o.namespace,
+			Name:      "operations_total",
+			Help:      "Number of encrypt and decrypt operations, by gRPC status code.",
+		}, append(labels, "code")),
+		duration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: o.namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of encrypt and decrypt operations.",
+			Buckets:   o.buckets,
+		}, labels),
+		bytes: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: o.namespace,
+			Name:      "operation_bytes_total",
+			Help:      "Number of bytes processed by encrypt and decrypt operations.",
+		}, labels),
+	}
+}
+
+// Observe records the observation in the exported metrics.
+func (s *Sink) Observe(ctx context.Context, observation metrics.Observation) {
+	op := string(observation.Operation)
+	s.operations.WithLabelValues(op, observation.Table, observation.Column, observation.Code.String()).Inc()
+	s.duration.WithLabelValues(op, observation.Table, observation.Column).Observe(observation.Duration.Seconds())
+	s.bytes.WithLabelValues(op, observation.Table, observation.Column).Add(float64(observation.Bytes))
+}
+
+// Describe implements prometheus.Collector.
+func (s *Sink) Describe(ch chan<- *prom.Desc) {
+	s.operations.Describe(ch)
+	s.duration.Describe(ch)
+	s.bytes.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *Sink) Collect(ch chan<- prom.Metric) {
+	s.operations.Collect(ch)
+	s.duration.Collect(ch)
+	s.bytes.Collect(ch)
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package prometheus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+
+	"github.com/cybercryptio/d1-gorm/metrics"
+)
+
+func TestSink(t *testing.T) {
+	sink := NewSink(WithNamespace("test"))
+
+	registry := prom.NewRegistry()
+	err := registry.Register(sink)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	sink.Observe(ctx, metrics.Observation{
+		Operation: metrics.OperationEncrypt, Table: "people", Column: "last_name", Code: codes.OK, Duration: time.Millisecond, Bytes: 3,
+	})
+	sink.Observe(ctx, metrics.Observation{
+		Operation: metrics.OperationDecrypt, Table: "people", Column: "last_name", Code: codes.OK, Duration: time.Millisecond, Bytes: 45,
+	})
+	sink.Observe(ctx, metrics.Observation{
+		Operation: metrics.OperationDecrypt, Table: "people", Column: "last_name", Code: codes.Unavailable, Duration: time.Second, Bytes: 45,
+	})
+
+	assert.Equal(t, 1.0, promtestutil.ToFloat64(sink.operations.WithLabelValues("encrypt", "people", "last_name", "OK")))
+	assert.Equal(t, 1.0, promtestutil.ToFloat64(sink.operations.WithLabelValues("decrypt", "people", "last_name", "OK")))
+	assert.Equal(t, 1.0, promtestutil.ToFloat64(sink.operations.WithLabelValues("decrypt", "people", "last_name", "Unavailable")))
+	assert.Equal(t, 3.0, promtestutil.ToFloat64(sink.bytes.WithLabelValues("encrypt", "people", "last_name")))
+	assert.Equal(t, 90.0, promtestutil.ToFloat64(sink.bytes.WithLabelValues("decrypt", "people", "last_name")))
+
+	count, err := promtestutil.GatherAndCount(registry, "test_operation_duration_seconds")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+}
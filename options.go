@@ -0,0 +1,168 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+type pluginOptions struct {
+	maxDecrypts int
+	policy      DecryptErrorPolicy
+	mask        string
+
+	plaintextWrites  PlaintextWritePolicy
+	encryptedQueries EncryptedQueryPolicy
+}
+
+// PluginOption is used to configure optional settings for the Plugin.
+type PluginOption func(*pluginOptions)
+
+func defaultPluginOptions() pluginOptions {
+	return pluginOptions{
+		policy:           DecryptErrorFail,
+		mask:             redacted,
+		plaintextWrites:  PlaintextWriteEncrypt,
+		encryptedQueries: EncryptedQueryError,
+	}
+}
+
+func (o *pluginOptions) apply(opts ...PluginOption) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithMaxDecrypts sets the maximum number of decryptions a single statement may perform. A statement exceeding it fails with
+// ErrDecryptBudgetExceeded. The limit can be overridden for a session with db.Set(MaxDecryptsSetting, n) and for a context with
+// ContextWithMaxDecrypts. The default is 0, which means no limit.
+func WithMaxDecrypts(maxDecrypts int) PluginOption {
+	return func(o *pluginOptions) {
+		o.maxDecrypts = maxDecrypts
+	}
+}
+
+// WithDecryptErrorPolicy sets how values that cannot be decrypted are handled. The policy can be overridden for a session with
+// db.Set(DecryptErrorPolicySetting, policy) and for a context with ContextWithDecryptErrorPolicy. The default is DecryptErrorFail.
+func WithDecryptErrorPolicy(policy DecryptErrorPolicy) PluginOption {
+	return func(o *pluginOptions) {
+		o.policy = policy
+	}
+}
+
+// WithMaskValue sets the value used to fill the fields that cannot be decrypted when the decryption error policy is DecryptErrorMask. The default
+// is "[REDACTED]".
+func WithMaskValue(mask string) PluginOption {
+	return func(o *pluginOptions) {
+		o.mask = mask
+	}
+}
+
+// WithPlaintextWritePolicy sets how values written to encrypted columns without going through the D1Serializer are handled, e.g. by
+// Update("column", value) or Create from a map. The default is PlaintextWriteEncrypt.
+func WithPlaintextWritePolicy(policy PlaintextWritePolicy) PluginOption {
+	return func(o *pluginOptions) {
+		o.plaintextWrites = policy
+	}
+}
+
+// WithEncryptedQueryPolicy sets how statements whose conditions or orderings refer to encrypted columns are handled. The policy can be overridden
+// for a session with db.Set(EncryptedQueryPolicySetting, policy). The default is EncryptedQueryError.
+func WithEncryptedQueryPolicy(policy EncryptedQueryPolicy) PluginOption {
+	return func(o *pluginOptions) {
+		o.encryptedQueries = policy
+	}
+}
+
+type serializerOptions struct {
+	padding             padding
+	compressThreshold   int
+	maxDecompressedSize int
+	cryptorOverhead     int
+	// err is the error of an invalid option, returned when encrypting.
+	err error
+}
+
+// SerializerOption is used to configure optional settings for the D1Serializer.
+type SerializerOption func(*serializerOptions)
+
+func defaultSerializerOptions() serializerOptions {
+	return serializerOptions{
+		maxDecompressedSize: defaultMaxDecompressedSize,
+		cryptorOverhead:     defaultCryptorOverhead,
+	}
+}
+
+func (o *serializerOptions) apply(opts ...SerializerOption) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithPadding pads the plaintexts to fixed sizes before they are encrypted, so that the length of the ciphertexts does not reveal the length of the
+// plaintexts but only their bucket. Plaintexts are padded to the smallest of the given sizes that holds them, or to a multiple of the largest size,
+// or to powers of two of at least 16 bytes if no size is given. Fields can override it with the pad setting of their d1 tag, e.g. `d1:"pad=off"`.
+// Padded and unpadded values can be read by any D1Serializer. Invalid sizes make the encryptions fail with ErrInvalidPadding.
+func WithPadding(sizes ...int) SerializerOption {
+	return func(o *serializerOptions) {
+		o.padding, o.err = newPadding(sizes...)
+	}
+}
+
+// WithCompression compresses the plaintexts of at least threshold bytes with gzip before they are encrypted, and before they are padded. Values that
+// do not shrink are stored uncompressed. Compressed values are decompressed when read by any D1Serializer, up to the size set with
+// WithMaxDecompressedSize. Note that compression makes the length of a ciphertext depend on the content of its plaintext. The default threshold
+// is 0, which disables the compression.
+func WithCompression(threshold int) SerializerOption {
+	return func(o *serializerOptions) {
+		o.compressThreshold = threshold
+	}
+}
+
+// WithMaxDecompressedSize sets the maximum size in bytes of a decompressed value. Reading a value exceeding it fails with
+// ErrDecompressedSizeExceeded, which guards against decompression bombs. The default is 64 MiB.
+func WithMaxDecompressedSize(size int) SerializerOption {
+	return func(o *serializerOptions) {
+		o.maxDecompressedSize = size
+	}
+}
+
+// WithCryptorOverhead sets the maximum number of bytes the Cryptor adds to a plaintext, which is used to size the columns of the encrypted fields
+// that have a maximum plaintext size, see AutoMigrate. The default is 256 bytes, which suits the D1Cryptor.
+func WithCryptorOverhead(overhead int) SerializerOption {
+	return func(o *serializerOptions) {
+		o.cryptorOverhead = overhead
+	}
+}
+
+type streamOptions struct {
+	chunkSize int
+}
+
+// StreamOption is used to configure optional settings for EncryptStream.
+type StreamOption func(*streamOptions)
+
+func defaultStreamOptions() streamOptions {
+	return streamOptions{chunkSize: defaultChunkSize}
+}
+
+func (o *streamOptions) apply(opts ...StreamOption) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithChunkSize sets the number of plaintext bytes encrypted in each chunk of a stream. The default is 1 MiB, and the maximum is 64 MiB.
+func WithChunkSize(chunkSize int) StreamOption {
+	return func(o *streamOptions) {
+		o.chunkSize = chunkSize
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// Error returned when the padding of a field is misconfigured, either with WithPadding or with the pad setting of its d1 tag.
+var ErrInvalidPadding = fmt.Errorf("invalid padding")
+
+// minPaddedSize is the smallest size plaintexts are padded to with power-of-two buckets.
+const minPaddedSize = 16
+
+// paddingMarker ends the plaintext within a padded value, and is followed by zeros up to the size of the bucket (ISO/IEC 7816-4 padding), so that
+// the padding can be stripped whatever the plaintext.
+const paddingMarker = 0x80
+
+// padding is the scheme used to pad plaintexts to fixed sizes before they are encrypted, so that the length of a ciphertext only reveals the bucket
+// of its plaintext.
+type padding struct {
+	enabled bool
+	// sizes are the sizes of the buckets in increasing order. Plaintexts are padded to powers of two if it is empty.
+	sizes []int
+}
+
+// newPadding returns a padding scheme with the given bucket sizes, or with power-of-two buckets if none is given.
+func newPadding(sizes ...int) (padding, error) {
+	sorted := append([]int(nil), sizes...)
+	sort.Ints(sorted)
+	for i, size := range sorted {
+		if size <= 0 || (i > 0 && size == sorted[i-1]) {
+			return padding{}, fmt.Errorf("%w: bucket sizes must be positive and distinct, got %v", ErrInvalidPadding, sizes)
+		}
+	}
+	return padding{enabled: true, sizes: sorted}, nil
+}
+
+// paddingOf returns the padding scheme of a field. The pad setting of its d1 tag takes precedence over the padding of the serializer: `d1:"pad"`
+// and `d1:"pad=pow2"` pad to powers of two, `d1:"pad=16,64,256"` to the listed sizes, and `d1:"pad=off"` disables the padding.
+func paddingOf(field *schema.Field, defaults padding) (padding, error) {
+	setting, ok := tagSettings(field)["pad"]
+	if !ok {
+		return defaults, nil
+	}
+
+	switch strings.ToLower(setting) {
+	case "", "pow2":
+		return newPadding()
+	case "off", "none":
+		return padding{}, nil
+	}
+
+	var sizes []int
+	for _, value := range strings.Split(setting, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return padding{}, fmt.Errorf("%w: pad setting %q of field %s", ErrInvalidPadding, setting, field.Name)
+		}
+		sizes = append(sizes, size)
+	}
+	return newPadding(sizes...)
+}
+
+// size returns the size of the bucket holding n bytes. Values larger than the largest configured bucket are padded to a multiple of it.
+func (p padding) size(n int) int {
+	if len(p.sizes) == 0 {
+		size := minPaddedSize
+		for size < n {
+			size *= 2
+		}
+		return size
+	}
+
+	for _, size := range p.sizes {
+		if size >= n {
+			return size
+		}
+	}
+	largest := p.sizes[len(p.sizes)-1]
+	return (n + largest - 1) / largest * largest
+}
+
+// pad returns the plaintext followed by the padding marker and zeros up to the size of its bucket.
+func (p padding) pad(plaintext []byte) []byte {
+	padded := make([]byte, p.size(len(plaintext)+1))
+	copy(padded, plaintext)
+	padded[len(plaintext)] = paddingMarker
+	return padded
+}
+
+// unpad strips the padding added by pad.
+func unpad(padded []byte) ([]byte, error) {
+	end := len(padded) - 1
+	for end >= 0 && padded[end] == 0 {
+		end--
+	}
+	if end < 0 || padded[end] != paddingMarker {
+		return nil, fmt.Errorf("missing padding marker: %w", crypto.ErrInvalidFormat)
+	}
+	return padded[:end], nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type PersonPadded struct {
+	ID        int
+	FirstName string `gorm:"serializer:D1"`
+	LastName  string `gorm:"serializer:D1" d1:"pad=32,64"`
+	Notes     []byte `gorm:"serializer:D1" d1:"pad=off"`
+}
+
+type PersonPaddedRaw struct {
+	ID        int
+	FirstName string
+	LastName  string
+	Notes     []byte
+}
+
+func (PersonPaddedRaw) TableName() string {
+	return "person_paddeds"
+}
+
+func newPaddingTestDB(t *testing.T, opts ...SerializerOption) *gorm.DB {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}, opts...))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&PersonPadded{})
+	assert.Nil(t, err)
+	return db
+}
+
+// reopenTestDB returns a new gorm.DB on the connection of db, which parses the schemas again with the serializers registered since.
+func reopenTestDB(t *testing.T, db *gorm.DB) *gorm.DB {
+	sqlDB, err := db.DB()
+	assert.Nil(t, err)
+	reopened, err := gorm.Open(&sqlite.Dialector{Conn: sqlDB}, &gorm.Config{})
+	assert.Nil(t, err)
+	return reopened
+}
+
+func storedPersonPadded(t *testing.T, db *gorm.DB, id int) PersonPaddedRaw {
+	var raw PersonPaddedRaw
+	err := db.First(&raw, id).Error
+	assert.Nil(t, err)
+	return raw
+}
+
+func TestPadding(t *testing.T) {
+	db := newPaddingTestDB(t, WithPadding())
+
+	people := []PersonPadded{
+		{1, "Al", "Doe", []byte("note")},
+		{2, "Bartholomew", "Vandenberghe-Montgomery", []byte("a longer note")},
+		{3, "Maximilian-Alexander", "Doe", nil},
+	}
+	err := db.Create(&people).Error
+	assert.Nil(t, err)
+
+	// Plaintexts of different lengths are stored with the length of their bucket
+	first, second, third := storedPersonPadded(t, db, 1), storedPersonPadded(t, db, 2), storedPersonPadded(t, db, 3)
+	assert.Equal(t, len(first.FirstName), len(second.FirstName))
+	assert.Greater(t, len(third.FirstName), len(second.FirstName))
+	assert.Equal(t, len(first.LastName), len(second.LastName))
+
+	// The padding of the tag takes precedence over the one of the serializer
+	ciphertext, err := base64.StdEncoding.DecodeString(first.LastName)
+	assert.Nil(t, err)
+	assert.Equal(t, len(envelopeMagic)+1+len("encrypted:")+32, len(ciphertext))
+	assert.Equal(t, []byte("encrypted:note"), first.Notes)
+
+	var found []PersonPadded
+	err = db.Order("id").Find(&found).Error
+	assert.Nil(t, err)
+	assert.Equal(t, people, found)
+}
+
+func TestPaddingCoexists(t *testing.T) {
+	db := newPaddingTestDB(t)
+
+	unpadded := PersonPadded{1, "John", "Doe", []byte("note")}
+	err := db.Create(&unpadded).Error
+	assert.Nil(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("encrypted:John")), storedPersonPadded(t, db, 1).FirstName)
+
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}, WithPadding(8, 24)))
+	padded := PersonPadded{2, "Jane", "Roe", []byte("note")}
+	err = reopenTestDB(t, db).Create(&padded).Error
+	assert.Nil(t, err)
+	assert.NotEqual(t, base64.StdEncoding.EncodeToString([]byte("encrypted:Jane")), storedPersonPadded(t, db, 2).FirstName)
+
+	// Both are read by the serializers with and without padding
+	for _, serializer := range []D1Serializer{NewD1Serializer(slowCryptor{}), NewD1Serializer(slowCryptor{}, WithPadding())} {
+		schema.RegisterSerializer("D1", serializer)
+		var found []PersonPadded
+		err = reopenTestDB(t, db).Order("id").Find(&found).Error
+		assert.Nil(t, err)
+		assert.Equal(t, []PersonPadded{unpadded, padded}, found)
+	}
+}
+
+func TestPaddingInvalid(t *testing.T) {
+	db := newPaddingTestDB(t, WithPadding(16, 0))
+	err := db.Create(&PersonPadded{1, "John", "Doe", nil}).Error
+	assert.ErrorIs(t, err, ErrInvalidPadding)
+
+	type PersonBadPadding struct {
+		ID       int
+		LastName string `gorm:"serializer:D1" d1:"pad=small"`
+	}
+	db = newPaddingTestDB(t)
+	err = db.AutoMigrate(&PersonBadPadding{})
+	assert.Nil(t, err)
+	err = db.Create(&PersonBadPadding{1, "Doe"}).Error
+	assert.ErrorIs(t, err, ErrInvalidPadding)
+}
+
+func TestPaddingRoundTrip(t *testing.T) {
+	sizes := map[int]int{0: 16, 15: 16, 16: 32, 100: 128}
+	for n, size := range sizes {
+		assert.Equal(t, size, padding{enabled: true}.size(n+1))
+	}
+	assert.Equal(t, 24, padding{enabled: true, sizes: []int{8, 24}}.size(9))
+	assert.Equal(t, 48, padding{enabled: true, sizes: []int{8, 24}}.size(25))
+
+	// The plaintext may itself end with the marker or with zeros
+	for _, plaintext := range [][]byte{{}, {0x80}, {0x80, 0}, []byte("Doe\x00\x00")} {
+		unpadded, err := unpad(padding{enabled: true}.pad(plaintext))
+		assert.Nil(t, err)
+		assert.Equal(t, plaintext, unpadded)
+	}
+
+	_, err := unpad([]byte{'D', 'o', 'e', 0})
+	assert.ErrorIs(t, err, crypto.ErrInvalidFormat)
+
+	_, _, err = openEnvelope(append(append([]byte{}, envelopeMagic...), 0x80))
+	assert.ErrorIs(t, err, crypto.ErrInvalidFormat)
+}
+
+func TestPaddingEncrypted(t *testing.T) {
+	type PersonPaddedEncrypted struct {
+		ID       int
+		LastName Encrypted[string] `gorm:"serializer:D1"`
+	}
+
+	db := newPaddingTestDB(t, WithPadding())
+	err := db.AutoMigrate(&PersonPaddedEncrypted{})
+	assert.Nil(t, err)
+
+	err = db.Create(&PersonPaddedEncrypted{ID: 1, LastName: NewEncrypted("Doe")}).Error
+	assert.Nil(t, err)
+
+	var person PersonPaddedEncrypted
+	err = db.First(&person, 1).Error
+	assert.Nil(t, err)
+	lastName, err := person.LastName.Reveal(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "Doe", lastName)
+}
@@ -0,0 +1,240 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Plugin is a gorm plugin that keeps track of the encryptions and decryptions performed by the D1Serializer during each statement. It is required
+// by the features that work on a per-statement basis, such as StatementStatsFromContext, the Logger and the decryption budget. It also guards
+// against plaintext being written to encrypted columns by the statements that bypass the D1Serializer, and against conditions and orderings on
+// encrypted columns, and it seals and unseals the field groups of the models. To use it, register it with db.Use(d1gorm.NewPlugin()).
+//
+// Fields tagged with `gorm:"-" d1:"group=<name>"` are sealed together, as a JSON object, into the encrypted string or []byte field whose name or
+// column is <name>. A row then costs a single encryption per group, and the columns do not reveal which of the fields are set. As a group is
+// stored as a whole, it is only written by the updates of all the fields of the model, e.g. with Save, and partial updates that set its fields
+// fail with ErrPartialGroupUpdate.
+type Plugin struct {
+	opts pluginOptions
+}
+
+// NewPlugin creates a new Plugin.
+func NewPlugin(opts ...PluginOption) *Plugin {
+	o := defaultPluginOptions()
+	o.apply(opts...)
+
+	return &Plugin{opts: o}
+}
+
+// Name returns the name of the plugin.
+func (p *Plugin) Name() string {
+	return "d1gorm"
+}
+
+// Initialize registers the callbacks of the plugin.
+func (p *Plugin) Initialize(db *gorm.DB) error {
+	callback := db.Callback()
+	operations := []struct {
+		name   string
+		before func(name string, fn func(*gorm.DB)) error
+		after  func(name string, fn func(*gorm.DB)) error
+	}{
+		{"create", callback.Create().Before("*").Register, callback.Create().After("*").Register},
+		{"query", callback.Query().Before("*").Register, callback.Query().After("*").Register},
+		{"update", callback.Update().Before("*").Register, callback.Update().After("*").Register},
+		{"delete", callback.Delete().Before("*").Register, callback.Delete().After("*").Register},
+		{"row", callback.Row().Before("*").Register, callback.Row().After("*").Register},
+		{"raw", callback.Raw().Before("*").Register, callback.Raw().After("*").Register},
+	}
+
+	for _, op := range operations {
+		if err := op.before(p.Name()+":before_"+op.name, p.before); err != nil {
+			return err
+		}
+		if err := op.after(p.Name()+":after_"+op.name, p.after); err != nil {
+			return err
+		}
+	}
+
+	checks := []struct {
+		name     string
+		register func(name string, fn func(*gorm.DB)) error
+	}{
+		{"query", callback.Query().Before("gorm:query").Register},
+		{"row", callback.Row().Before("gorm:row").Register},
+		{"delete", callback.Delete().Before("gorm:delete").Register},
+	}
+	for _, check := range checks {
+		if err := check.register(p.Name()+":check_"+check.name, p.checkQuery); err != nil {
+			return err
+		}
+	}
+
+	if err := callback.Row().Before("gorm:row").Register(p.Name()+":check_rows", p.checkRows); err != nil {
+		return err
+	}
+	if err := callback.Query().After("gorm:preload").Before("gorm:after_query").Register(p.Name()+":decrypt_results", p.decryptResults); err != nil {
+		return err
+	}
+	if err := callback.Query().After("gorm:preload").Before("gorm:after_query").Register(p.Name()+":unseal_groups", p.unsealGroups); err != nil {
+		return err
+	}
+
+	// gorm v1.23 only keeps the order of its own callbacks for chains of at most 12 callbacks, so the steps preceding a write are registered as one.
+	if err := callback.Create().Before("gorm:create").Register(p.Name()+":prepare_create", p.prepareCreate); err != nil {
+		return err
+	}
+	if err := callback.Update().Before("gorm:update").Register(p.Name()+":prepare_update", p.prepareUpdate); err != nil {
+		return err
+	}
+	return callback.Update().After("gorm:update").Register(p.Name()+":restore_update", p.restoreWrites)
+}
+
+// before attaches a new statement scope to the statement context.
+func (p *Plugin) before(db *gorm.DB) {
+	ctx := db.Statement.Context
+	outer, _ := statementScopeFromContext(ctx)
+	if outer != nil && outer.statement == db.Statement {
+		// The statement is being reused, so the scope of its previous execution is replaced. The context is otherwise kept, since other plugins
+		// may have added values to it since.
+		outer = outer.outer
+	}
+
+	scope := &statementScope{
+		statement:   db.Statement,
+		outer:       outer,
+		maxDecrypts: p.maxDecrypts(ctx, db),
+		policy:      p.decryptErrorPolicy(ctx, db),
+		mask:        p.opts.mask,
+	}
+	db.Statement.Context = context.WithValue(ctx, statementScopeCtxKey{}, scope)
+}
+
+// maxDecrypts returns the decryption budget of the statement. The context takes precedence over the session settings, which take precedence over
+// the options of the plugin.
+func (p *Plugin) maxDecrypts(ctx context.Context, db *gorm.DB) int {
+	if maxDecrypts, ok := ctx.Value(maxDecryptsCtxKey{}).(int); ok {
+		return maxDecrypts
+	}
+	if value, ok := db.Get(MaxDecryptsSetting); ok {
+		if maxDecrypts, ok := value.(int); ok {
+			return maxDecrypts
+		}
+	}
+	return p.opts.maxDecrypts
+}
+
+// decryptErrorPolicy returns the decryption error policy of the statement. The context takes precedence over the session settings, which take
+// precedence over the options of the plugin.
+func (p *Plugin) decryptErrorPolicy(ctx context.Context, db *gorm.DB) DecryptErrorPolicy {
+	if policy, ok := ctx.Value(decryptErrorPolicyCtxKey{}).(DecryptErrorPolicy); ok {
+		return policy
+	}
+	if value, ok := db.Get(DecryptErrorPolicySetting); ok {
+		if policy, ok := value.(DecryptErrorPolicy); ok {
+			return policy
+		}
+	}
+	return p.opts.policy
+}
+
+// after removes the rows dropped according to the decryption error policy from the results, along with their withheld values, and prepares a
+// redacted explanation of the statement to be used for logging.
+func (p *Plugin) after(db *gorm.DB) {
+	scope, ok := statementScopeFromContext(db.Statement.Context)
+	if !ok || scope.statement != db.Statement {
+		return
+	}
+
+	scope.mu.Lock()
+	dropped := scope.dropped
+	scope.mu.Unlock()
+	dropRows(db, dropped)
+	scope.dropWithheld(dropped)
+
+	var (
+		sql       = db.Statement.SQL.String()
+		vars      = redactVars(db.Statement.Vars)
+		rows      = db.RowsAffected
+		dialector = db.Dialector
+	)
+
+	scope.mu.Lock()
+	defer scope.mu.Unlock()
+	scope.explain = func() (string, int64) {
+		return dialector.Explain(sql, vars...), rows
+	}
+}
+
+// redacted is the value shown instead of encrypted values.
+const redacted = "[REDACTED]"
+
+// redactVars returns a copy of the statement variables in which the values of fields serialized by the D1Serializer, and the values encrypted by
+// the Plugin, are redacted.
+func redactVars(vars []interface{}) []interface{} {
+	redactedVars := make([]interface{}, len(vars))
+	for i, v := range vars {
+		if _, ok := v.(guardedValue); ok {
+			redactedVars[i] = redacted
+		} else if field, ok := serializedField(v); ok && isEncrypted(field) {
+			redactedVars[i] = redacted
+		} else {
+			redactedVars[i] = v
+		}
+	}
+	return redactedVars
+}
+
+// serializedField returns the field of a statement variable holding the value of a field with a serializer. Such values are passed to the driver
+// wrapped in the unexported type schema.serializer, which calls the serializer when the driver asks for the value.
+func serializedField(v interface{}) (*schema.Field, bool) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct || rv.Type().PkgPath() != reflect.TypeOf(schema.Field{}).PkgPath() {
+		return nil, false
+	}
+
+	fv := rv.FieldByName("Field")
+	if !fv.IsValid() {
+		return nil, false
+	}
+
+	field, ok := fv.Interface().(*schema.Field)
+	return field, ok && field != nil
+}
+
+// isEncrypted returns true if the field is serialized by the D1Serializer.
+func isEncrypted(field *schema.Field) bool {
+	_, ok := field.Serializer.(D1Serializer)
+	return ok
+}
+
+// prepareCreate seals the field groups of the models being created and guards against plaintext written by the statement.
+func (p *Plugin) prepareCreate(db *gorm.DB) {
+	p.sealGroups(db, false)
+	p.guardWrites(db)
+}
+
+// prepareUpdate checks the conditions of the statement, seals the field groups of the models being updated and guards against plaintext
+// written by the statement.
+func (p *Plugin) prepareUpdate(db *gorm.DB) {
+	p.checkQuery(db)
+	p.sealGroups(db, true)
+	p.guardWrites(db)
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+func TestDecryptBudget(t *testing.T) {
+	type PersonString struct {
+		ID        int
+		FirstName string
+		LastName  string `gorm:"serializer:D1"`
+	}
+
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	db := testutil.NewTestDB(t)
+	err := db.Use(NewPlugin(WithMaxDecrypts(2)))
+	assert.Nil(t, err)
+
+	err = db.AutoMigrate(&PersonString{})
+	assert.Nil(t, err)
+
+	people := make([]PersonString, 5)
+	for i := range people {
+		people[i] = PersonString{i + 1, "John", fmt.Sprintf("Doe%d", i)}
+	}
+	err = db.Create(&people).Error
+	assert.Nil(t, err)
+
+	// The plugin's budget applies to all statements
+	var found []PersonString
+	err = db.Order("id").Find(&found).Error
+	assert.ErrorIs(t, err, ErrDecryptBudgetExceeded)
+	assert.Equal(t, 1, strings.Count(err.Error(), ErrDecryptBudgetExceeded.Error()))
+	assert.Len(t, found, 5)
+	assert.Equal(t, people[:2], found[:2])
+	for _, p := range found[2:] {
+		assert.Empty(t, p.LastName)
+	}
+
+	found = nil
+	err = db.Order("id").Limit(2).Find(&found).Error
+	assert.Nil(t, err)
+	assert.Equal(t, people[:2], found)
+
+	// The budget can be overridden with a setting
+	found = nil
+	err = db.Set(MaxDecryptsSetting, 5).Order("id").Find(&found).Error
+	assert.Nil(t, err)
+	assert.Equal(t, people, found)
+
+	err = db.Set(MaxDecryptsSetting, 1).Order("id").Find(&[]PersonString{}).Error
+	assert.ErrorIs(t, err, ErrDecryptBudgetExceeded)
+
+	// The context takes precedence over the setting
+	found = nil
+	ctx := ContextWithMaxDecrypts(context.Background(), 0)
+	err = db.WithContext(ctx).Set(MaxDecryptsSetting, 1).Order("id").Find(&found).Error
+	assert.Nil(t, err)
+	assert.Equal(t, people, found)
+}
+
+type PersonHooked struct {
+	ID        int
+	FirstName string
+	LastName  string `gorm:"serializer:D1"`
+	stored    string
+}
+
+func (p *PersonHooked) AfterUpdate(tx *gorm.DB) error {
+	return tx.Session(&gorm.Session{NewDB: true}).Model(&PersonHooked{}).Where("id = ?", p.ID).Pluck("first_name", &p.stored).Error
+}
+
+func TestPluginKeepsCallbackOrder(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	db := testutil.NewTestDB(t)
+	err := db.Use(NewPlugin())
+	assert.Nil(t, err)
+
+	err = db.AutoMigrate(&PersonHooked{})
+	assert.Nil(t, err)
+
+	person := &PersonHooked{ID: 1, FirstName: "John", LastName: "Doe"}
+	err = db.Create(person).Error
+	assert.Nil(t, err)
+
+	// The hooks of gorm run around the update itself
+	person.FirstName = "Jim"
+	err = db.Save(person).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "Jim", person.stored)
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// DecryptErrorPolicy determines how the D1Serializer handles values that cannot be decrypted, e.g. because the caller lacks permission to access
+// them or because the ciphertext is corrupt.
+type DecryptErrorPolicy int
+
+const (
+	// DecryptErrorFail fails the statement with the error. This is the default policy.
+	DecryptErrorFail DecryptErrorPolicy = iota
+	// DecryptErrorZero leaves the field empty.
+	DecryptErrorZero
+	// DecryptErrorMask fills the field with the mask value set with WithMaskValue.
+	DecryptErrorMask
+	// DecryptErrorDropRow removes the row from the results. When querying a single row, the row is cleared and the statement fails with
+	// gorm.ErrRecordNotFound, if the query would have failed with it had the row not existed.
+	DecryptErrorDropRow
+)
+
+// DecryptErrorPolicySetting is the gorm setting used to override the decryption error policy of the statements of a session, e.g.
+// db.Set(d1gorm.DecryptErrorPolicySetting, d1gorm.DecryptErrorDropRow).Find(&users).
+const DecryptErrorPolicySetting = "d1:decrypt_error_policy"
+
+type decryptErrorPolicyCtxKey struct{}
+
+// ContextWithDecryptErrorPolicy returns a copy of ctx that overrides the decryption error policy of the statements executed with it.
+func ContextWithDecryptErrorPolicy(ctx context.Context, policy DecryptErrorPolicy) context.Context {
+	return context.WithValue(ctx, decryptErrorPolicyCtxKey{}, policy)
+}
+
+// DecryptErrors returns the errors of the fields that could not be decrypted by the statement that produced tx, and that were withheld according
+// to the decryption error policy. This includes the errors of the statements executed to preload associations. It requires the Plugin to be
+// registered.
+func DecryptErrors(tx *gorm.DB) []*FieldError {
+	scope, ok := statementScopeFromContext(tx.Statement.Context)
+	if !ok {
+		return nil
+	}
+
+	scope.mu.Lock()
+	defer scope.mu.Unlock()
+	return append([]*FieldError(nil), scope.fieldErrors...)
+}
+
+// decryptFailed handles a field that could not be decrypted according to the decryption error policy of the statement.
+func decryptFailed(ctx context.Context, field *schema.Field, dst reflect.Value, row int, err error) error {
+	return withholdFailed(ctx, field, dst, row, err, func(mask []byte) error {
+		if mask == nil {
+			return field.Set(ctx, dst, nil)
+		}
+		if field.FieldType.Kind() == reflect.String {
+			return field.Set(ctx, dst, string(mask))
+		}
+		return field.Set(ctx, dst, mask)
+	})
+}
+
+// withholdFailed handles a value of field that could not be decrypted according to the decryption error policy of the statement. The value is
+// withheld by calling set with the mask value, or with nil to clear it.
+func withholdFailed(ctx context.Context, field *schema.Field, dst reflect.Value, row int, err error, set func(mask []byte) error) error {
+	fieldErr := newFieldError(ctx, OperationDecrypt, field, dst, err)
+
+	scope, ok := statementScopeFromContext(ctx)
+	if !ok || scope.policy == DecryptErrorFail {
+		return fieldErr
+	}
+	scope.recordFieldError(field, fieldErr, row)
+
+	if scope.policy == DecryptErrorMask {
+		return set([]byte(scope.mask))
+	}
+	return set(nil)
+}
+
+// dropRows removes the rows marked to be dropped from the results of the statement.
+func dropRows(db *gorm.DB, dropped map[int]bool) {
+	if len(dropped) == 0 {
+		return
+	}
+
+	rv := db.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice:
+		kept := reflect.MakeSlice(rv.Type(), 0, rv.Len()-len(dropped))
+		for i := 0; i < rv.Len(); i++ {
+			if !dropped[i] {
+				kept = reflect.Append(kept, rv.Index(i))
+			}
+		}
+		rv.Set(kept)
+	case reflect.Struct:
+		rv.Set(reflect.Zero(rv.Type()))
+		if db.Statement.RaiseErrorOnNotFound {
+			_ = db.AddError(gorm.ErrRecordNotFound)
+		}
+	default:
+		return
+	}
+	db.RowsAffected -= int64(len(dropped))
+}
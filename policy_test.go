@@ -0,0 +1,135 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type PersonPolicy struct {
+	ID        int
+	FirstName string
+	LastName  string `gorm:"serializer:D1"`
+	Notes     []byte `gorm:"serializer:D1"`
+}
+
+func newPolicyTestDB(t *testing.T, opts ...PluginOption) *gorm.DB {
+	cryptor := &testutil.CryptorMock{}
+	for _, value := range []string{"Doe", "Roe", "Poe", "note"} {
+		cryptor.On("Encrypt", mock.Anything, []byte(value)).Return([]byte(value+"encrypt"), nil)
+	}
+	for _, value := range []string{"Doe", "Poe", "note"} {
+		cryptor.On("Decrypt", mock.Anything, []byte(value+"encrypt")).Return([]byte(value), nil)
+	}
+	cryptor.On("Decrypt", mock.Anything, []byte("Roeencrypt")).Return(nil, status.Error(codes.PermissionDenied, "denied"))
+	schema.RegisterSerializer("D1", NewD1Serializer(cryptor))
+
+	db := testutil.NewTestDB(t)
+	err := db.Use(NewPlugin(opts...))
+	assert.Nil(t, err)
+
+	err = db.AutoMigrate(&PersonPolicy{})
+	assert.Nil(t, err)
+
+	err = db.Create(&[]PersonPolicy{
+		{1, "John", "Doe", []byte("note")},
+		{2, "Jane", "Roe", []byte("note")},
+		{3, "Jim", "Poe", []byte("note")},
+	}).Error
+	assert.Nil(t, err)
+	return db
+}
+
+func TestDecryptErrorPolicyFail(t *testing.T) {
+	db := newPolicyTestDB(t)
+
+	var people []PersonPolicy
+	tx := db.Order("id").Find(&people)
+	assert.ErrorIs(t, tx.Error, ErrPermissionDenied)
+	assert.Empty(t, DecryptErrors(tx))
+}
+
+func TestDecryptErrorPolicyZero(t *testing.T) {
+	db := newPolicyTestDB(t)
+
+	var people []PersonPolicy
+	tx := db.Set(DecryptErrorPolicySetting, DecryptErrorZero).Order("id").Find(&people)
+	assert.Nil(t, tx.Error)
+	assert.Equal(t, []PersonPolicy{
+		{1, "John", "Doe", []byte("note")},
+		{2, "Jane", "", []byte("note")},
+		{3, "Jim", "Poe", []byte("note")},
+	}, people)
+
+	errs := DecryptErrors(tx)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, "last_name", errs[0].Column)
+	assert.Equal(t, "2", errs[0].PrimaryKey)
+	assert.ErrorIs(t, errs[0], ErrPermissionDenied)
+}
+
+func TestDecryptErrorPolicyMask(t *testing.T) {
+	db := newPolicyTestDB(t, WithDecryptErrorPolicy(DecryptErrorMask), WithMaskValue("***"))
+
+	var people []PersonPolicy
+	tx := db.Order("id").Find(&people)
+	assert.Nil(t, tx.Error)
+	assert.Equal(t, "***", people[1].LastName)
+	assert.Len(t, DecryptErrors(tx), 1)
+
+	// The context takes precedence over the plugin options
+	ctx := ContextWithDecryptErrorPolicy(context.Background(), DecryptErrorFail)
+	err := db.WithContext(ctx).Order("id").Find(&people).Error
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+}
+
+func TestDecryptErrorPolicyDropRow(t *testing.T) {
+	db := newPolicyTestDB(t, WithDecryptErrorPolicy(DecryptErrorDropRow))
+
+	var people []PersonPolicy
+	tx := db.Order("id").Find(&people)
+	assert.Nil(t, tx.Error)
+	assert.Equal(t, int64(2), tx.RowsAffected)
+	assert.Equal(t, []PersonPolicy{
+		{1, "John", "Doe", []byte("note")},
+		{3, "Jim", "Poe", []byte("note")},
+	}, people)
+	assert.Len(t, DecryptErrors(tx), 1)
+
+	var pointers []*PersonPolicy
+	err := db.Order("id").Find(&pointers).Error
+	assert.Nil(t, err)
+	assert.Len(t, pointers, 2)
+	assert.Equal(t, 3, pointers[1].ID)
+
+	person := PersonPolicy{}
+	err = db.First(&person, 2).Error
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	assert.Equal(t, PersonPolicy{}, person)
+
+	err = db.First(&person, 3).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "Poe", person.LastName)
+}
@@ -0,0 +1,268 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// ErrEncryptedQuery is returned when a statement filters or sorts on an encrypted column. The D1Serializer encrypts values non-deterministically,
+// so such conditions never match and such orderings sort by ciphertext.
+var ErrEncryptedQuery = fmt.Errorf("encrypted columns cannot be used in conditions or orderings")
+
+// EncryptedQueryPolicy determines how the Plugin handles statements whose WHERE or ORDER BY clauses refer to encrypted columns. Comparisons with
+// NULL are allowed, as NULL values are not encrypted.
+type EncryptedQueryPolicy int
+
+const (
+	// EncryptedQueryError fails the statement with ErrEncryptedQuery. This is the default policy.
+	EncryptedQueryError EncryptedQueryPolicy = iota
+	// EncryptedQueryWarn logs a warning with the logger of the database, and executes the statement.
+	EncryptedQueryWarn
+	// EncryptedQueryOff executes the statement without checking it.
+	EncryptedQueryOff
+)
+
+// EncryptedQueryPolicySetting is the gorm setting used to override the encrypted query policy of the statements of a session, e.g.
+// db.Set(d1gorm.EncryptedQueryPolicySetting, d1gorm.EncryptedQueryOff).Find(&users).
+const EncryptedQueryPolicySetting = "d1:encrypted_query_policy"
+
+// checkQuery checks the WHERE and ORDER BY clauses of the statement for references to encrypted columns.
+func (p *Plugin) checkQuery(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+
+	policy := p.opts.encryptedQueries
+	if value, ok := db.Get(EncryptedQueryPolicySetting); ok {
+		if v, ok := value.(EncryptedQueryPolicy); ok {
+			policy = v
+		}
+	}
+	if policy == EncryptedQueryOff {
+		return
+	}
+
+	checker := queryChecker{schema: db.Statement.Schema, table: db.Statement.Table}
+	if c, ok := db.Statement.Clauses["WHERE"]; ok {
+		checker.clause = "WHERE"
+		checker.expression(c.Expression)
+	}
+	if c, ok := db.Statement.Clauses["ORDER BY"]; ok {
+		checker.clause = "ORDER BY"
+		checker.expression(c.Expression)
+	}
+	if len(checker.fields) == 0 {
+		return
+	}
+
+	err := fmt.Errorf("%w: %s", ErrEncryptedQuery, strings.Join(checker.fields, ", "))
+	if policy == EncryptedQueryWarn {
+		db.Logger.Warn(db.Statement.Context, "%v", err)
+		return
+	}
+	_ = db.AddError(err)
+}
+
+// queryChecker collects the references to encrypted columns found in the expressions of a clause.
+type queryChecker struct {
+	schema *schema.Schema
+	table  string
+	clause string
+	fields []string
+}
+
+func (c *queryChecker) expression(expr clause.Expression) {
+	switch e := expr.(type) {
+	case clause.Where:
+		c.expressions(e.Exprs)
+	case clause.AndConditions:
+		c.expressions(e.Exprs)
+	case clause.OrConditions:
+		c.expressions(e.Exprs)
+	case clause.NotConditions:
+		c.expressions(e.Exprs)
+	case clause.Expr:
+		c.sql(e.SQL)
+	case clause.NamedExpr:
+		c.sql(e.SQL)
+	case clause.Eq:
+		if e.Value != nil {
+			c.column(e.Column)
+		}
+	case clause.Neq:
+		if e.Value != nil {
+			c.column(e.Column)
+		}
+	case clause.Gt:
+		c.column(e.Column)
+	case clause.Gte:
+		c.column(e.Column)
+	case clause.Lt:
+		c.column(e.Column)
+	case clause.Lte:
+		c.column(e.Column)
+	case clause.Like:
+		c.column(e.Column)
+	case clause.IN:
+		c.column(e.Column)
+	case clause.OrderBy:
+		for _, column := range e.Columns {
+			c.column(column.Column)
+		}
+		if e.Expression != nil {
+			c.expression(e.Expression)
+		}
+	}
+}
+
+func (c *queryChecker) expressions(exprs []clause.Expression) {
+	for _, expr := range exprs {
+		c.expression(expr)
+	}
+}
+
+// column checks a column given as a string or as a clause.Column, which may hold raw SQL.
+func (c *queryChecker) column(column interface{}) {
+	switch col := column.(type) {
+	case string:
+		c.sql(col)
+	case clause.Column:
+		if col.Raw || col.Table == "" {
+			c.sql(col.Name)
+		} else {
+			c.reference(col.Table, col.Name)
+		}
+	}
+}
+
+// sql checks the column references of an SQL fragment. References followed by IS, e.g. in "column IS NULL", are allowed.
+func (c *queryChecker) sql(sql string) {
+	tokens := sqlTokens(sql)
+	for i, token := range tokens {
+		if token.name == "" || (i+1 < len(tokens) && strings.EqualFold(tokens[i+1].name, "is") && tokens[i+1].qualifier == "") {
+			continue
+		}
+		c.reference(token.qualifier, token.name)
+	}
+}
+
+// reference records the referenced column if it is encrypted.
+func (c *queryChecker) reference(table, name string) {
+	if table != "" && table != clause.CurrentTable && table != c.table && table != c.schema.Table {
+		return
+	}
+
+	field := c.schema.LookUpField(name)
+	if field == nil {
+		for _, f := range c.schema.Fields {
+			if strings.EqualFold(f.DBName, name) {
+				field = f
+				break
+			}
+		}
+	}
+	if field == nil || !isEncrypted(field) {
+		return
+	}
+
+	reference := fmt.Sprintf("%s.%s in %s", c.schema.Table, field.DBName, c.clause)
+	for _, f := range c.fields {
+		if f == reference {
+			return
+		}
+	}
+	c.fields = append(c.fields, reference)
+}
+
+// sqlToken is an identifier found in an SQL fragment, possibly qualified by a table name.
+type sqlToken struct {
+	qualifier string
+	name      string
+}
+
+// sqlTokens splits an SQL fragment into identifiers, skipping string literals. Tokens that are not identifiers are returned with an empty name, so
+// that identifiers can be checked for what follows them.
+func sqlTokens(sql string) []sqlToken {
+	var (
+		tokens []sqlToken
+		runes  = []rune(sql)
+		dotted bool
+	)
+
+	push := func(name string) {
+		if dotted && len(tokens) > 0 && tokens[len(tokens)-1].name != "" {
+			last := &tokens[len(tokens)-1]
+			last.qualifier, last.name = last.name, name
+		} else {
+			tokens = append(tokens, sqlToken{name: name})
+		}
+		dotted = false
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\'':
+			// Skip string literals, in which quotes are escaped by doubling them.
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			tokens = append(tokens, sqlToken{})
+			dotted = false
+		case r == '"' || r == '`' || r == '[':
+			end := r
+			if r == '[' {
+				end = ']'
+			}
+			start := i + 1
+			for i++; i < len(runes) && runes[i] != end; i++ {
+			}
+			push(string(runes[start:i]))
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i+1 < len(runes) && (runes[i+1] == '_' || runes[i+1] == '$' || unicode.IsLetter(runes[i+1]) || unicode.IsDigit(runes[i+1])) {
+				i++
+			}
+			push(string(runes[start : i+1]))
+		case r == '@':
+			// Skip named arguments.
+			for i+1 < len(runes) && (runes[i+1] == '_' || unicode.IsLetter(runes[i+1]) || unicode.IsDigit(runes[i+1])) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{})
+			dotted = false
+		case r == '.':
+			dotted = true
+		case unicode.IsSpace(r):
+		default:
+			tokens = append(tokens, sqlToken{})
+			dotted = false
+		}
+	}
+	return tokens
+}
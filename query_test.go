@@ -0,0 +1,95 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+func TestEncryptedQueryError(t *testing.T) {
+	db := newGuardTestDB(t)
+
+	var people []PersonGuard
+	queries := map[string]*gorm.DB{
+		"raw condition":       db.Where("last_name = ?", "Doe"),
+		"quoted condition":    db.Where("`person_guards`.`last_name` = ?", "Doe"),
+		"function condition":  db.Where("first_name = ? OR LOWER(last_name) LIKE ?", "John", "doe"),
+		"struct condition":    db.Where(&PersonGuard{LastName: "Doe"}),
+		"map condition":       db.Where(map[string]interface{}{"last_name": "Doe"}),
+		"field name":          db.Where(map[string]interface{}{"LastName": "Doe"}),
+		"not condition":       db.Not("notes = ?", []byte("note")),
+		"or condition":        db.Where("id = 1").Or("last_name = ?", "Doe"),
+		"inline condition":    db.Session(&gorm.Session{}),
+		"order":               db.Order("last_name desc"),
+		"order by expression": db.Order(clause.OrderByColumn{Column: clause.Column{Name: "last_name"}}),
+	}
+	for name, query := range queries {
+		var err error
+		if name == "inline condition" {
+			err = query.Find(&people, "last_name = ?", "Doe").Error
+		} else {
+			err = query.Find(&people).Error
+		}
+		assert.ErrorIs(t, err, ErrEncryptedQuery, name)
+	}
+
+	err := db.Model(&PersonGuard{}).Where("last_name = ?", "Doe").Update("first_name", "Jim").Error
+	assert.ErrorIs(t, err, ErrEncryptedQuery)
+	err = db.Where("last_name = ?", "Doe").Delete(&PersonGuard{}).Error
+	assert.ErrorIs(t, err, ErrEncryptedQuery)
+	var count int64
+	err = db.Model(&PersonGuard{}).Where("last_name = ?", "Doe").Count(&count).Error
+	assert.ErrorIs(t, err, ErrEncryptedQuery)
+	assert.Contains(t, err.Error(), "person_guards.last_name in WHERE")
+}
+
+func TestEncryptedQueryAllowed(t *testing.T) {
+	db := newGuardTestDB(t)
+
+	var people []PersonGuard
+	queries := []*gorm.DB{
+		db.Where("first_name = ?", "John"),
+		db.Where("last_name IS NOT NULL"),
+		db.Where("first_name = 'last_name'"),
+		db.Where("first_name = @last_name", map[string]interface{}{"last_name": "John"}),
+		db.Where(map[string]interface{}{"last_name": nil}).Or("id = 1"),
+		db.Order("first_name, id desc"),
+		db.Set(EncryptedQueryPolicySetting, EncryptedQueryOff).Where("last_name = ?", "Doe"),
+	}
+	for _, query := range queries {
+		err := query.Find(&people).Error
+		assert.Nil(t, err)
+	}
+}
+
+func TestEncryptedQueryWarn(t *testing.T) {
+	db := newGuardTestDB(t, WithEncryptedQueryPolicy(EncryptedQueryWarn))
+	buf := &bytes.Buffer{}
+	db.Logger = logger.New(log.New(buf, "", 0), logger.Config{LogLevel: logger.Warn})
+
+	var people []PersonGuard
+	err := db.Order("last_name").Find(&people).Error
+	assert.Nil(t, err)
+	assert.Len(t, people, 1)
+	assert.Contains(t, buf.String(), ErrEncryptedQuery.Error())
+	assert.Contains(t, buf.String(), "person_guards.last_name in ORDER BY")
+}
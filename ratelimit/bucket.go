@@ -0,0 +1,59 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// bucket is a token bucket that is refilled at the rate of its Limit, up to its burst size.
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit Limit, now time.Time) *bucket {
+	return &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+		b.last = now
+	}
+}
+
+// available returns true if a token can be taken from the bucket.
+func (b *bucket) available() bool {
+	return b.tokens >= 1
+}
+
+// take removes a token from the bucket, possibly leaving it in debt, and returns the time until the debt is repaid.
+func (b *bucket) take() time.Duration {
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second))
+}
+
+// full returns true if the bucket holds as many tokens as a new bucket.
+func (b *bucket) full() bool {
+	return b.tokens >= float64(b.limit.Burst)
+}
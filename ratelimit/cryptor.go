@@ -0,0 +1,218 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package ratelimit provides a Cryptor that limits the rate of decryptions performed on behalf of each identity, to slow down and expose bulk
+// exfiltration of encrypted data.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// ErrRateLimited is returned by Decrypt when a limit is exceeded and the action is ActionBlock.
+var ErrRateLimited = fmt.Errorf("decryption rate limit exceeded")
+
+// Limit is a token bucket limit on the number of decryptions.
+type Limit struct {
+	// Rate is the number of decryptions per second allowed in the long run.
+	Rate float64
+	// Burst is the number of decryptions that can be performed at once.
+	Burst int
+}
+
+// unlimited returns true if the limit does not restrict decryptions.
+func (l Limit) unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// Action is the action taken by the Cryptor when a limit is exceeded.
+type Action int
+
+const (
+	// ActionBlock fails the decryption with ErrRateLimited.
+	ActionBlock Action = iota
+	// ActionThrottle delays the decryption until it is allowed by the limits, or the context is done.
+	ActionThrottle
+	// ActionAlert allows the decryption, and only calls the alert function.
+	ActionAlert
+)
+
+// Violation describes a decryption that exceeded a limit.
+type Violation struct {
+	Identity string
+	// Table and Column identify the decrypted field. They are empty if the Cryptor was not called by the D1Serializer.
+	Table  string
+	Column string
+	// Limit is the limit that was exceeded.
+	Limit Limit
+	// Action is the action taken by the Cryptor.
+	Action Action
+}
+
+// maxIdleBuckets is the number of buckets above which full buckets, which are equivalent to new ones, are discarded.
+const maxIdleBuckets = 10000
+
+// sweepInterval is the minimum time between two sweeps of the buckets, unless their number has doubled since the last sweep.
+const sweepInterval = time.Minute
+
+type bucketKey struct {
+	identity string
+	column   column
+}
+
+type keyedLimit struct {
+	key   bucketKey
+	limit Limit
+}
+
+// Cryptor is an implementation of the Cryptor interface that enforces a limit on the rate of decryptions performed by each identity, and optionally
+// on the rate of decryptions of specific columns. Calls with no identity in the context share the limits of the empty identity. Encryptions are not
+// limited.
+type Cryptor struct {
+	cryptor crypto.Cryptor
+	limit   Limit
+	opts    options
+	now     func() time.Time
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*bucket
+	// lastSweep is the time of the last sweep of the buckets, and swept the number of buckets it kept.
+	lastSweep time.Time
+	swept     int
+}
+
+// NewCryptor creates a new Cryptor that limits the decryptions performed with the provided Cryptor by each identity to the provided limit. A zero
+// limit only enforces the column limits.
+func NewCryptor(cryptor crypto.Cryptor, limit Limit, opts ...Option) *Cryptor {
+	o := defaultOptions()
+	o.apply(opts...)
+
+	return &Cryptor{
+		cryptor: cryptor,
+		limit:   limit,
+		opts:    o,
+		now:     time.Now,
+		buckets: map[bucketKey]*bucket{},
+	}
+}
+
+// Encrypt calls Encrypt on the wrapped Cryptor.
+func (c *Cryptor) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return c.cryptor.Encrypt(ctx, plaintext)
+}
+
+// Decrypt calls Decrypt on the wrapped Cryptor if the limits of the caller allow it. Otherwise it takes the configured action.
+func (c *Cryptor) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	identity := c.opts.identity(ctx)
+	info, _ := crypto.FieldInfoFromContext(ctx)
+
+	col := column{table: info.Table, column: info.Column}
+	limits := []keyedLimit{{bucketKey{identity: identity}, c.limit}}
+	if limit, ok := c.opts.columnLimits[col]; ok {
+		limits = append(limits, keyedLimit{bucketKey{identity: identity, column: col}, limit})
+	}
+
+	wait, exceeded, allowed := c.take(limits)
+	if allowed {
+		return c.cryptor.Decrypt(ctx, ciphertext)
+	}
+
+	c.opts.alert(ctx, Violation{Identity: identity, Table: info.Table, Column: info.Column, Limit: exceeded, Action: c.opts.action})
+
+	switch c.opts.action {
+	case ActionThrottle:
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	case ActionAlert:
+	default:
+		return nil, ErrRateLimited
+	}
+
+	return c.cryptor.Decrypt(ctx, ciphertext)
+}
+
+// take takes a token from the buckets of the provided limits. If a bucket is empty, it returns false along with the exceeded limit. In that case,
+// tokens are only taken if the action is not ActionBlock, and the returned duration is the time until all the buckets are out of debt.
+func (c *Cryptor) take(limits []keyedLimit) (time.Duration, Limit, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.sweep(now)
+
+	buckets := make([]*bucket, 0, len(limits))
+	var exceeded *Limit
+	for _, l := range limits {
+		if l.limit.unlimited() {
+			continue
+		}
+
+		b, ok := c.buckets[l.key]
+		if !ok || b.limit != l.limit {
+			b = newBucket(l.limit, now)
+			c.buckets[l.key] = b
+		}
+		b.refill(now)
+		if !b.available() && exceeded == nil {
+			exceeded = &b.limit
+		}
+		buckets = append(buckets, b)
+	}
+
+	if exceeded != nil && c.opts.action == ActionBlock {
+		return 0, *exceeded, false
+	}
+
+	var wait time.Duration
+	for _, b := range buckets {
+		if w := b.take(); w > wait {
+			wait = w
+		}
+	}
+
+	if exceeded != nil {
+		return wait, *exceeded, false
+	}
+	return 0, Limit{}, true
+}
+
+// sweep discards the full buckets when there are too many of them, so that the memory used by the Cryptor does not grow with the number of
+// identities seen. Sweeping walks all the buckets, so it is done at most once per sweepInterval, or when the number of buckets has doubled since
+// the last sweep, which keeps its cost constant per decryption.
+func (c *Cryptor) sweep(now time.Time) {
+	if len(c.buckets) < maxIdleBuckets {
+		return
+	}
+	if now.Sub(c.lastSweep) < sweepInterval && len(c.buckets) < 2*c.swept {
+		return
+	}
+
+	for key, b := range c.buckets {
+		b.refill(now)
+		if b.full() {
+			delete(c.buckets, key)
+		}
+	}
+	c.lastSweep, c.swept = now, len(c.buckets)
+}
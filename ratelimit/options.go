@@ -0,0 +1,82 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package ratelimit
+
+import (
+	"context"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+type column struct {
+	table  string
+	column string
+}
+
+type options struct {
+	action       Action
+	columnLimits map[column]Limit
+	identity     func(ctx context.Context) string
+	alert        func(ctx context.Context, violation Violation)
+}
+
+// Option is used to configure optional settings for the rate limiting Cryptor.
+type Option func(*options)
+
+func defaultOptions() options {
+	return options{
+		action:       ActionBlock,
+		columnLimits: map[column]Limit{},
+		identity: func(ctx context.Context) string {
+			identity, _ := crypto.IdentityFromContext(ctx)
+			return identity
+		},
+		alert: func(ctx context.Context, violation Violation) {},
+	}
+}
+
+func (o *options) apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithAction sets the action taken when a limit is exceeded. The default action is ActionBlock.
+func WithAction(action Action) Option {
+	return func(o *options) {
+		o.action = action
+	}
+}
+
+// WithColumnLimit sets a limit on the decryptions of a single column by each identity, in addition to the overall limit of the identity.
+func WithColumnLimit(table, col string, limit Limit) Option {
+	return func(o *options) {
+		o.columnLimits[column{table: table, column: col}] = limit
+	}
+}
+
+// WithIdentityFunc sets the function used to extract the identity of the caller from the context. The default is crypto.IdentityFromContext.
+func WithIdentityFunc(identity func(ctx context.Context) string) Option {
+	return func(o *options) {
+		o.identity = identity
+	}
+}
+
+// WithAlertFunc sets the function called whenever a limit is exceeded, regardless of the action taken.
+func WithAlertFunc(alert func(ctx context.Context, violation Violation)) Option {
+	return func(o *options) {
+		o.alert = alert
+	}
+}
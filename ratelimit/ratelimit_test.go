@@ -0,0 +1,181 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestCryptor(limit Limit, opts ...Option) (*Cryptor, *fakeClock) {
+	cryptorMock := &testutil.CryptorMock{}
+	cryptorMock.On("Decrypt", mock.Anything, mock.Anything).Return([]byte("plaintext"), nil)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cryptor := NewCryptor(cryptorMock, limit, opts...)
+	cryptor.now = clock.Now
+	return cryptor, clock
+}
+
+func identityContext(identity string) context.Context {
+	return crypto.ContextWithIdentity(context.Background(), identity)
+}
+
+func fieldContext(identity, table, column string) context.Context {
+	return crypto.ContextWithFieldInfo(identityContext(identity), crypto.FieldInfo{Table: table, Column: column})
+}
+
+func TestBlock(t *testing.T) {
+	var violations []Violation
+	cryptor, clock := newTestCryptor(Limit{Rate: 1, Burst: 2}, WithAlertFunc(func(ctx context.Context, violation Violation) {
+		violations = append(violations, violation)
+	}))
+
+	alice := identityContext("alice")
+	for i := 0; i < 2; i++ {
+		_, err := cryptor.Decrypt(alice, []byte("ciphertext"))
+		assert.Nil(t, err)
+	}
+	_, err := cryptor.Decrypt(alice, []byte("ciphertext"))
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	// Other identities have their own limits
+	_, err = cryptor.Decrypt(identityContext("bob"), []byte("ciphertext"))
+	assert.Nil(t, err)
+
+	// Blocked decryptions do not consume tokens, so a token is available after a second
+	clock.Advance(time.Second)
+	_, err = cryptor.Decrypt(alice, []byte("ciphertext"))
+	assert.Nil(t, err)
+	_, err = cryptor.Decrypt(alice, []byte("ciphertext"))
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	assert.Equal(t, []Violation{
+		{Identity: "alice", Limit: Limit{Rate: 1, Burst: 2}, Action: ActionBlock},
+		{Identity: "alice", Limit: Limit{Rate: 1, Burst: 2}, Action: ActionBlock},
+	}, violations)
+}
+
+func TestColumnLimit(t *testing.T) {
+	columnLimit := Limit{Rate: 1, Burst: 1}
+	cryptor, clock := newTestCryptor(Limit{Rate: 100, Burst: 100}, WithColumnLimit("people", "ssn", columnLimit))
+
+	ssn := fieldContext("alice", "people", "ssn")
+	lastName := fieldContext("alice", "people", "last_name")
+
+	_, err := cryptor.Decrypt(ssn, []byte("ciphertext"))
+	assert.Nil(t, err)
+	_, err = cryptor.Decrypt(ssn, []byte("ciphertext"))
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	for i := 0; i < 10; i++ {
+		_, err = cryptor.Decrypt(lastName, []byte("ciphertext"))
+		assert.Nil(t, err)
+	}
+
+	clock.Advance(time.Second)
+	_, err = cryptor.Decrypt(ssn, []byte("ciphertext"))
+	assert.Nil(t, err)
+}
+
+func TestAlert(t *testing.T) {
+	var violations []Violation
+	cryptor, _ := newTestCryptor(Limit{Rate: 1, Burst: 1}, WithAction(ActionAlert),
+		WithAlertFunc(func(ctx context.Context, violation Violation) {
+			violations = append(violations, violation)
+		}))
+
+	ctx := fieldContext("alice", "people", "ssn")
+	for i := 0; i < 3; i++ {
+		_, err := cryptor.Decrypt(ctx, []byte("ciphertext"))
+		assert.Nil(t, err)
+	}
+
+	assert.Len(t, violations, 2)
+	assert.Equal(t, Violation{Identity: "alice", Table: "people", Column: "ssn", Limit: Limit{Rate: 1, Burst: 1}, Action: ActionAlert}, violations[0])
+}
+
+func TestThrottle(t *testing.T) {
+	cryptorMock := &testutil.CryptorMock{}
+	cryptorMock.On("Decrypt", mock.Anything, mock.Anything).Return([]byte("plaintext"), nil)
+
+	cryptor := NewCryptor(cryptorMock, Limit{Rate: 20, Burst: 1}, WithAction(ActionThrottle))
+
+	ctx := identityContext("alice")
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := cryptor.Decrypt(ctx, []byte("ciphertext"))
+		assert.Nil(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := cryptor.Decrypt(ctx, []byte("ciphertext"))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestSweep(t *testing.T) {
+	cryptor, clock := newTestCryptor(Limit{Rate: 1, Burst: 2})
+	decrypt := func(identity string) {
+		_, err := cryptor.Decrypt(identityContext(identity), []byte("ciphertext"))
+		assert.Nil(t, err)
+	}
+
+	// None of the buckets are full, so the first sweep keeps them all
+	for i := 0; i <= maxIdleBuckets; i++ {
+		decrypt(fmt.Sprint(i))
+	}
+	assert.Equal(t, clock.Now(), cryptor.lastSweep)
+	assert.Equal(t, maxIdleBuckets, cryptor.swept)
+	assert.Len(t, cryptor.buckets, maxIdleBuckets+1)
+
+	// The buckets are not walked again until the interval has passed, even though they are full by then
+	clock.Advance(2 * time.Second)
+	decrypt("alice")
+	assert.Len(t, cryptor.buckets, maxIdleBuckets+2)
+
+	clock.Advance(sweepInterval)
+	decrypt("bob")
+	assert.Equal(t, clock.Now(), cryptor.lastSweep)
+	assert.Len(t, cryptor.buckets, 1)
+
+	// Unless the number of buckets has doubled since the last sweep
+	clock.Advance(time.Second)
+	for i := 0; i < 2*maxIdleBuckets; i++ {
+		decrypt(fmt.Sprint(i))
+	}
+	assert.Equal(t, clock.Now(), cryptor.lastSweep)
+}
@@ -0,0 +1,46 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+)
+
+type withoutDecryptionCtxKey struct{}
+
+type withoutEncryptionCtxKey struct{}
+
+// WithoutDecryption returns a copy of ctx with which the D1Serializer does not decrypt the values read from the database, and instead sets the fields
+// to the values as they are stored. Together with WithoutEncryption, it allows copying encrypted data through the usual gorm models without ever
+// seeing the plaintext or calling the Cryptor.
+func WithoutDecryption(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutDecryptionCtxKey{}, true)
+}
+
+// WithoutEncryption returns a copy of ctx with which the D1Serializer does not encrypt the values written to the database, and instead writes the
+// values of the fields as they are. The fields must hold values that are already encrypted, e.g. read with WithoutDecryption.
+func WithoutEncryption(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutEncryptionCtxKey{}, true)
+}
+
+func isWithoutDecryption(ctx context.Context) bool {
+	without, _ := ctx.Value(withoutDecryptionCtxKey{}).(bool)
+	return without
+}
+
+func isWithoutEncryption(ctx context.Context) bool {
+	without, _ := ctx.Value(withoutEncryptionCtxKey{}).(bool)
+	return without
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+func TestCopyWithoutDecryption(t *testing.T) {
+	type PersonRaw struct {
+		ID        int
+		FirstName string
+		LastName  string `gorm:"serializer:D1"`
+		Notes     []byte `gorm:"serializer:D1"`
+	}
+
+	type PersonRawUnencrypted struct {
+		ID        int
+		FirstName string
+		LastName  string
+		Notes     []byte
+	}
+
+	cryptor := &testutil.CryptorMock{}
+	cryptor.On("Encrypt", mock.Anything, []byte("Doe")).Once().Return([]byte("Doencrypt"), nil)
+	cryptor.On("Encrypt", mock.Anything, []byte("note")).Once().Return([]byte("notencrypt"), nil)
+	cryptor.On("Decrypt", mock.Anything, []byte("Doencrypt")).Once().Return([]byte("Doe"), nil)
+	cryptor.On("Decrypt", mock.Anything, []byte("notencrypt")).Once().Return([]byte("note"), nil)
+	schema.RegisterSerializer("D1", NewD1Serializer(cryptor))
+
+	source := testutil.NewTestDB(t)
+	destination := testutil.NewTestDB(t)
+	for _, db := range []*gorm.DB{source, destination} {
+		err := db.AutoMigrate(&PersonRaw{})
+		assert.Nil(t, err)
+	}
+
+	err := source.Create(&PersonRaw{1, "John", "Doe", []byte("note")}).Error
+	assert.Nil(t, err)
+
+	// Copy the rows without decrypting and re-encrypting them
+	ctx := context.Background()
+	var people []PersonRaw
+	err = source.WithContext(WithoutDecryption(ctx)).Find(&people).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []PersonRaw{{1, "John", base64.StdEncoding.EncodeToString([]byte("Doencrypt")), []byte("notencrypt")}}, people)
+
+	err = destination.WithContext(WithoutEncryption(ctx)).Create(&people).Error
+	assert.Nil(t, err)
+
+	// The stored values are identical
+	var sourceRaw, destinationRaw []PersonRawUnencrypted
+	err = source.Table("person_raws").Find(&sourceRaw).Error
+	assert.Nil(t, err)
+	err = destination.Table("person_raws").Find(&destinationRaw).Error
+	assert.Nil(t, err)
+	assert.Equal(t, sourceRaw, destinationRaw)
+
+	// The copy can be decrypted as usual
+	person := &PersonRaw{}
+	err = destination.First(person).Error
+	assert.Nil(t, err)
+	assert.Equal(t, PersonRaw{1, "John", "Doe", []byte("note")}, *person)
+
+	cryptor.AssertExpectations(t)
+}
+
+func TestWithoutDecryptionReusedBuffer(t *testing.T) {
+	type PersonNotes struct {
+		ID    int
+		Notes []byte `gorm:"serializer:D1"`
+	}
+
+	serializer := NewD1Serializer(slowCryptor{})
+	schema.RegisterSerializer("D1", serializer)
+	sch, err := schema.Parse(&PersonNotes{}, &sync.Map{}, schema.NamingStrategy{})
+	assert.Nil(t, err)
+
+	// The driver reuses its buffer for the next row after the ciphertext is copied into the model
+	buffer := []byte("encrypted:note")
+	person := &PersonNotes{}
+	err = serializer.Scan(WithoutDecryption(context.Background()), sch.LookUpField("Notes"), reflect.ValueOf(person).Elem(), buffer)
+	assert.Nil(t, err)
+	copy(buffer, "encrypted:next")
+
+	assert.Equal(t, []byte("encrypted:note"), person.Notes)
+}
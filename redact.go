@@ -0,0 +1,261 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm/schema"
+)
+
+// ErrUnknownMask is returned by Redact when a field is tagged with an unknown mask.
+var ErrUnknownMask = fmt.Errorf("unknown mask")
+
+// masks are the partial masks that can be set on encrypted fields with the d1 tag, e.g. `gorm:"serializer:D1" d1:"mask=last4"`. Fields without a
+// mask are fully redacted.
+var masks = map[string]func(string) string{
+	// last4 keeps the last four characters of values longer than eight characters.
+	"last4": func(value string) string {
+		runes := []rune(value)
+		if len(runes) <= 8 {
+			return redacted
+		}
+		return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+	},
+	// email keeps the domain of email addresses.
+	"email": func(value string) string {
+		at := strings.LastIndex(value, "@")
+		if at < 0 {
+			return redacted
+		}
+		return redacted + value[at:]
+	},
+}
+
+// maskedField is a field of a struct type that Redact may mask.
+type maskedField struct {
+	name     string
+	index    []int
+	settings map[string]string
+	// serializer is the name of the serializer set by the gorm tag, and grouped is set for the members of sealed groups.
+	serializer string
+	grouped    bool
+}
+
+// masked returns whether the field is serialized by the D1Serializer or is a member of a sealed group. The members of sealed groups are
+// encrypted with the column of their group. The serializer is looked up on each call, since it may be registered after the field is parsed.
+func (f maskedField) masked() bool {
+	if f.grouped {
+		return true
+	}
+	if f.serializer == "" {
+		return false
+	}
+	serializer, ok := schema.GetSerializer(f.serializer)
+	if !ok {
+		return false
+	}
+	_, ok = serializer.(D1Serializer)
+	return ok
+}
+
+// maskedFields caches the fields of the struct types redacted by Redact that may be masked.
+var maskedFields sync.Map
+
+// maskedFieldsOf returns the fields of the struct type t that set a serializer or are members of sealed groups. They are found from the struct
+// tags rather than by parsing t as a gorm model, so that structs that are not valid models, such as responses wrapping models, can be redacted
+// too. The fields of embedded structs are masked when the embedded struct itself is redacted.
+func maskedFieldsOf(t reflect.Type) []maskedField {
+	if fields, ok := maskedFields.Load(t); ok {
+		return fields.([]maskedField)
+	}
+
+	var fields []maskedField
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+		field := maskedField{name: structField.Name, index: structField.Index, settings: parseTagSettings(structField.Tag)}
+		_, field.grouped = field.settings["group"]
+		gormSettings := schema.ParseTagSetting(structField.Tag.Get("gorm"), ";")
+		if _, ignored := gormSettings["-"]; !ignored {
+			field.serializer = gormSettings["SERIALIZER"]
+		}
+		if field.grouped || field.serializer != "" {
+			fields = append(fields, field)
+		}
+	}
+	maskedFields.Store(t, fields)
+	return fields
+}
+
+// Redact returns a deep copy of model in which the values of the fields serialized by the D1Serializer are masked, so that it can be logged or
+// reported safely. The members of sealed field groups are masked as well. It follows nested structs, pointers, slices, maps and associations.
+// String, []byte and Secret fields are set to a redacted value, or partially masked according to the mask setting of their d1 tag, and other
+// encrypted fields are cleared.
+func Redact[T any](model T) (T, error) {
+	r := redactor{visited: map[uintptr]reflect.Value{}}
+	copied, err := r.redact(reflect.ValueOf(&model).Elem())
+	if err != nil {
+		return model, err
+	}
+	return copied.Interface().(T), nil
+}
+
+// redactor deep copies values while masking their encrypted fields.
+type redactor struct {
+	// visited holds the copies of the pointers already visited, so that cycles are preserved.
+	visited map[uintptr]reflect.Value
+}
+
+// redact returns an addressable copy of v with its encrypted fields masked.
+func (r redactor) redact(v reflect.Value) (reflect.Value, error) {
+	copied := reflect.New(v.Type()).Elem()
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return copied, nil
+		}
+		if ptr, ok := r.visited[v.Pointer()]; ok {
+			copied.Set(ptr)
+			return copied, nil
+		}
+		ptr := reflect.New(v.Type().Elem())
+		r.visited[v.Pointer()] = ptr
+		elem, err := r.redact(v.Elem())
+		if err != nil {
+			return copied, err
+		}
+		ptr.Elem().Set(elem)
+		copied.Set(ptr)
+	case reflect.Interface:
+		if v.IsNil() {
+			return copied, nil
+		}
+		elem, err := r.redact(v.Elem())
+		if err != nil {
+			return copied, err
+		}
+		copied.Set(elem)
+	case reflect.Slice:
+		if v.IsNil() {
+			return copied, nil
+		}
+		copied.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+		fallthrough
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			elem, err := r.redact(v.Index(i))
+			if err != nil {
+				return copied, err
+			}
+			copied.Index(i).Set(elem)
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return copied, nil
+		}
+		copied.Set(reflect.MakeMapWithSize(v.Type(), v.Len()))
+		iter := v.MapRange()
+		for iter.Next() {
+			elem, err := r.redact(iter.Value())
+			if err != nil {
+				return copied, err
+			}
+			copied.SetMapIndex(iter.Key(), elem)
+		}
+	case reflect.Struct:
+		copied.Set(v)
+		if err := r.redactStruct(copied); err != nil {
+			return copied, err
+		}
+	default:
+		copied.Set(v)
+	}
+	return copied, nil
+}
+
+// redactStruct deep copies the exported fields of the addressable struct v in place, and masks its encrypted fields.
+func (r redactor) redactStruct(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+		field, err := r.redact(v.Field(i))
+		if err != nil {
+			return err
+		}
+		v.Field(i).Set(field)
+	}
+	for _, field := range maskedFieldsOf(v.Type()) {
+		if !field.masked() {
+			continue
+		}
+		if err := maskField(field, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maskField masks the value of an encrypted field of the addressable struct v.
+func maskField(field maskedField, v reflect.Value) error {
+	fv, ok := fieldByIndex(v, field.index)
+	if !ok || fv.IsZero() {
+		return nil
+	}
+
+	mask := func(string) string { return redacted }
+	if name, ok := field.settings["mask"]; ok {
+		if mask, ok = masks[name]; !ok {
+			return fmt.Errorf("%w %q on field %s", ErrUnknownMask, name, field.name)
+		}
+	}
+
+	switch value := fv.Interface().(type) {
+	case string:
+		fv.SetString(mask(value))
+	case []byte:
+		fv.SetBytes([]byte(mask(string(value))))
+	case secretValue:
+		if scanner, ok := fv.Addr().Interface().(sql.Scanner); ok {
+			return scanner.Scan(mask(fmt.Sprintf("%s", value.exposed())))
+		}
+		fv.Set(reflect.Zero(fv.Type()))
+	default:
+		fv.Set(reflect.Zero(fv.Type()))
+	}
+	return nil
+}
+
+// fieldByIndex returns the field of v at the provided index path, or false if it is behind a nil pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return v, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm/schema"
+)
+
+type RedactAddress struct {
+	ID       int
+	PersonID int
+	Street   string `gorm:"serializer:D1"`
+	City     string
+}
+
+type RedactContact struct {
+	Email string `gorm:"serializer:D1" d1:"mask=email"`
+	Phone string `gorm:"serializer:D1" d1:"mask=last4"`
+}
+
+type RedactPerson struct {
+	ID        int
+	CreatedAt time.Time
+	Name      string
+	SSN       []byte                 `gorm:"serializer:D1"`
+	Notes     Secret[string]         `gorm:"serializer:D1"`
+	Lazy      Encrypted[string]      `gorm:"serializer:D1"`
+	Contact   RedactContact          `gorm:"embedded"`
+	Addresses []RedactAddress        `gorm:"foreignKey:PersonID"`
+	Home      *RedactAddress         `gorm:"foreignKey:PersonID"`
+	Tags      map[string]interface{} `gorm:"-"`
+}
+
+func TestRedact(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	created := time.Now()
+	person := &RedactPerson{
+		ID:        1,
+		CreatedAt: created,
+		Name:      "John",
+		SSN:       []byte("123-45-6789"),
+		Notes:     NewSecret("note"),
+		Lazy:      NewEncrypted("lazy"),
+		Contact:   RedactContact{Email: "john@example.com", Phone: "+45 1234 5678"},
+		Addresses: []RedactAddress{{1, 1, "Main Street 1", "Aarhus"}},
+		Home:      &RedactAddress{2, 1, "Side Street 2", "Aarhus"},
+		Tags:      map[string]interface{}{"address": RedactAddress{Street: "Back Street 3"}},
+	}
+
+	redactedPerson, err := Redact(person)
+	assert.Nil(t, err)
+	assert.Equal(t, &RedactPerson{
+		ID:        1,
+		CreatedAt: created,
+		Name:      "John",
+		SSN:       []byte(redacted),
+		Notes:     NewSecret(redacted),
+		Contact:   RedactContact{Email: redacted + "@example.com", Phone: "*********5678"},
+		Addresses: []RedactAddress{{1, 1, redacted, "Aarhus"}},
+		Home:      &RedactAddress{2, 1, redacted, "Aarhus"},
+		Tags:      map[string]interface{}{"address": RedactAddress{Street: redacted}},
+	}, redactedPerson)
+
+	// The model is left untouched
+	assert.Equal(t, []byte("123-45-6789"), person.SSN)
+	assert.Equal(t, "note", person.Notes.Expose())
+	assert.Equal(t, "Main Street 1", person.Addresses[0].Street)
+	assert.Equal(t, "Side Street 2", person.Home.Street)
+
+	// Slices of models and non-model structs are redacted as well
+	type Response struct {
+		People []RedactPerson
+		Total  int
+	}
+	response, err := Redact(Response{People: []RedactPerson{*person}, Total: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(redacted), response.People[0].SSN)
+	assert.Equal(t, redacted, response.People[0].Addresses[0].Street)
+}
+
+func TestRedactSealedGroups(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	person := PersonGroup{
+		ID:        1,
+		FirstName: "Michael",
+		Email:     "michael@example.com",
+		Phone:     "12345678",
+		Birthday:  time.Date(1958, 8, 29, 0, 0, 0, 0, time.UTC),
+		Age:       50,
+		Profile:   `{"Email":"michael@example.com"}`,
+		Notes:     []byte("note"),
+		Accounts:  []AccountGroup{{ID: 1, Number: "DK001"}},
+	}
+
+	redactedPerson, err := Redact(person)
+	assert.Nil(t, err)
+	assert.Equal(t, PersonGroup{
+		ID:        1,
+		FirstName: "Michael",
+		Email:     redacted,
+		Phone:     redacted,
+		Profile:   redacted,
+		Notes:     []byte(redacted),
+		Accounts:  []AccountGroup{{ID: 1, Number: redacted}},
+	}, redactedPerson)
+}
+
+func TestRedactInvalidModel(t *testing.T) {
+	// gorm cannot parse the relationship of Owner, as RedactAddress has no foreign key to it
+	type Invoice struct {
+		ID      int
+		Account string `gorm:"serializer:D1" d1:"mask=last4"`
+		Owner   RedactAddress
+	}
+
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	invoice, err := Redact(Invoice{ID: 1, Account: "DK50 0040 0440 1162 43", Owner: RedactAddress{Street: "Main Street 1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "******************2 43", invoice.Account)
+	assert.Equal(t, redacted, invoice.Owner.Street)
+}
+
+func TestRedactLateRegistration(t *testing.T) {
+	type PersonLate struct {
+		ID  int
+		SSN string `gorm:"serializer:D1Late"`
+	}
+
+	// The fields are masked once the serializer is registered, even if the struct was redacted before
+	redactedPerson, err := Redact(PersonLate{1, "123-45-6789"})
+	assert.Nil(t, err)
+	assert.Equal(t, "123-45-6789", redactedPerson.SSN)
+
+	schema.RegisterSerializer("D1Late", NewD1Serializer(slowCryptor{}))
+	redactedPerson, err = Redact(PersonLate{1, "123-45-6789"})
+	assert.Nil(t, err)
+	assert.Equal(t, redacted, redactedPerson.SSN)
+}
+
+func TestRedactUnknownMask(t *testing.T) {
+	type PersonMask struct {
+		ID   int
+		Name string `gorm:"serializer:D1" d1:"mask=first4"`
+	}
+
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+
+	_, err := Redact(PersonMask{1, "John"})
+	assert.ErrorIs(t, err, ErrUnknownMask)
+}
@@ -0,0 +1,463 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"unsafe"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// DecryptResults decrypts in place the values of the encrypted columns of the model of the statement that produced tx, which were scanned into
+// dest without going through the D1Serializer. This is the case when scanning into maps, into structs whose fields are not tagged with the D1
+// serializer, or into slices of plain values. The Plugin does so automatically for the results of queries, e.g. with Find or Pluck, but results
+// scanned outside of the gorm callbacks, with Scan or Rows, must be decrypted explicitly when they are not scanned into the model, e.g.:
+//
+//	tx := db.Model(&Person{}).Scan(&dto)
+//	err := d1gorm.DecryptResults(tx, &dto)
+//
+// String, []byte and Secret values are supported, as well as pointers to them. The decryptions count towards the decryption budget of the
+// statement, and values that cannot be decrypted are handled according to its decryption error policy. Errors are returned as a *FieldError,
+// except for ErrDecryptBudgetExceeded.
+func DecryptResults(tx *gorm.DB, dest interface{}) error {
+	if tx.Statement.Model == nil {
+		return nil
+	}
+
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(tx.Statement.Model); err != nil {
+		return err
+	}
+
+	var budgetErr error
+	d := resultDecryptor{
+		ctx:       tx.Statement.Context,
+		db:        tx,
+		schema:    stmt.Schema,
+		column:    selectedColumn(tx.Statement),
+		aliases:   selectAliases(tx.Statement),
+		joins:     joinedRelations(tx.Statement),
+		budgetErr: &budgetErr,
+	}
+	if err := d.decrypt(reflect.ValueOf(dest)); err != nil {
+		return err
+	}
+	return budgetErr
+}
+
+// ErrUndecryptedRows is returned by the Scan method of the row returned by Row when it reads encrypted columns of the model of the statement. The
+// values of a single row are scanned into plain values outside of the gorm callbacks, so they cannot be decrypted automatically. Use
+// ScanUndecrypted to scan them anyway.
+var ErrUndecryptedRows = fmt.Errorf("the rows hold encrypted columns that are scanned without being decrypted")
+
+type scanUndecryptedCtxKey struct{}
+
+// ScanUndecrypted returns a copy of ctx with which Row may read encrypted columns of the model of the statement, whose values are then decrypted
+// by the caller, e.g. with DecryptResults. Statements executed with WithoutDecryption may read them as well.
+//
+// Scan and Rows are not checked, since their rows may be scanned into the model, whose fields are decrypted by the D1Serializer, and gorm does not
+// let the Plugin know their destination before they are scanned. Their results must be decrypted with DecryptResults when they are scanned into
+// other destinations.
+func ScanUndecrypted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scanUndecryptedCtxKey{}, true)
+}
+
+// checkRows fails the statements reading a single row of a model with Row, if the selected columns include encrypted ones and the caller did not
+// accept to decrypt them. The query is not executed, and Row returns a row whose Scan method returns the error.
+func (p *Plugin) checkRows(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil || db.Statement.Model == nil || isWithoutDecryption(db.Statement.Context) {
+		return
+	}
+	if rows, ok := db.Get("rows"); !ok || rows != false {
+		return
+	}
+	if accepted, _ := db.Statement.Context.Value(scanUndecryptedCtxKey{}).(bool); accepted {
+		return
+	}
+
+	d := resultDecryptor{schema: db.Statement.Schema, joins: joinedRelations(db.Statement)}
+	if column, ok := d.selectsEncrypted(db.Statement); ok {
+		err := db.AddError(fmt.Errorf("%w: column %s of table %s", ErrUndecryptedRows, column, db.Statement.Table))
+		db.Statement.Dest = erroredRow(err)
+	}
+}
+
+// erroredRow returns a row whose Scan method returns err, for Row to return instead of nil when the query is not executed. database/sql does not
+// export a way to build one, so the error is set through reflection.
+func erroredRow(err error) *sql.Row {
+	row := &sql.Row{}
+	field := reflect.ValueOf(row).Elem().FieldByName("err")
+	reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Set(reflect.ValueOf(err))
+	return row
+}
+
+// selectsEncrypted returns an encrypted column selected by the statement, if any. Statements that do not select columns explicitly select all of
+// them.
+func (d resultDecryptor) selectsEncrypted(stmt *gorm.Statement) (string, bool) {
+	var columns []string
+	for _, sel := range stmt.Selects {
+		columns = append(columns, strings.Split(sel, ",")...)
+	}
+	if c, ok := stmt.Clauses["SELECT"]; ok {
+		if sel, ok := c.Expression.(clause.Select); ok {
+			for _, column := range sel.Columns {
+				columns = append(columns, column.Name)
+			}
+		}
+	}
+
+	if len(columns) == 0 {
+		columns = []string{"*"}
+	}
+	for _, column := range columns {
+		if match := selectAlias.FindStringSubmatch(column); match != nil {
+			column = match[1]
+		}
+		if column = strings.TrimSpace(column); column == "*" || strings.HasSuffix(column, ".*") {
+			for _, field := range d.schema.Fields {
+				if field.DBName != "" && isEncrypted(field) {
+					return field.DBName, true
+				}
+			}
+			continue
+		}
+		if field := d.encryptedField(column); field != nil {
+			return field.DBName, true
+		}
+	}
+	return "", false
+}
+
+// decryptResults decrypts the results of a query whose destination is not its model.
+func (p *Plugin) decryptResults(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Model == nil || db.Statement.Dest == nil || isWithoutDecryption(db.Statement.Context) {
+		return
+	}
+	if destType, modelType := elemType(db.Statement.Dest), elemType(db.Statement.Model); destType == modelType {
+		return
+	}
+	if err := DecryptResults(db, db.Statement.Dest); err != nil {
+		_ = db.AddError(err)
+	}
+}
+
+// elemType returns the type of the values held by v, through pointers, slices and arrays.
+func elemType(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	return t
+}
+
+// selectedColumn returns the column selected by the statement, if it selects exactly one, e.g. with Pluck.
+func selectedColumn(stmt *gorm.Statement) string {
+	if c, ok := stmt.Clauses["SELECT"]; ok {
+		if sel, ok := c.Expression.(clause.Select); ok && len(sel.Columns) == 1 && !sel.Columns[0].Raw {
+			return sel.Columns[0].Name
+		}
+	}
+	if len(stmt.Selects) == 1 {
+		return stmt.Selects[0]
+	}
+	return ""
+}
+
+// selectAlias matches a selected column with an alias, e.g. "users.email AS contact".
+var selectAlias = regexp.MustCompile("(?i)^\\s*([\\w.`\"]+)\\s+(?:as\\s+)?([\\w`\"]+)\\s*$")
+
+// selectAliases returns the aliases of the columns selected by the statement.
+func selectAliases(stmt *gorm.Statement) map[string]string {
+	selects := append([]string(nil), stmt.Selects...)
+	if c, ok := stmt.Clauses["SELECT"]; ok {
+		if sel, ok := c.Expression.(clause.Select); ok {
+			for _, column := range sel.Columns {
+				selects = append(selects, column.Name)
+			}
+			if expr, ok := sel.Expression.(clause.Expr); ok {
+				selects = append(selects, expr.SQL)
+			}
+		}
+	}
+
+	aliases := map[string]string{}
+	for _, sel := range selects {
+		for _, column := range strings.Split(sel, ",") {
+			if match := selectAlias.FindStringSubmatch(column); match != nil {
+				aliases[strings.Trim(match[2], "`\"")] = match[1]
+			}
+		}
+	}
+	return aliases
+}
+
+// joinedRelations returns the names of the relationships joined by the statement, e.g. with Joins("Profile"). Once the query is built, gorm moves
+// them to the joins of the FROM clause, aliased with the name of the relationship.
+func joinedRelations(stmt *gorm.Statement) map[string]bool {
+	joins := map[string]bool{}
+	for _, join := range stmt.Joins {
+		joins[join.Name] = true
+	}
+	if c, ok := stmt.Clauses["FROM"]; ok {
+		if from, ok := c.Expression.(clause.From); ok {
+			for _, join := range from.Joins {
+				joins[join.Table.Alias] = true
+			}
+		}
+	}
+	return joins
+}
+
+// resultDecryptor decrypts the encrypted columns of a schema held by a destination.
+type resultDecryptor struct {
+	ctx    context.Context
+	db     *gorm.DB
+	schema *schema.Schema
+	// column is the single column selected by the statement, used to decrypt slices of plain values.
+	column string
+	// aliases maps the aliases of the columns selected by the statement to the columns.
+	aliases map[string]string
+	// joins holds the names of the relationships joined by the statement, whose columns may be selected without a table name.
+	joins map[string]bool
+	// row is the index of the row being decrypted, and budgetErr is set when the decryption budget of the statement is exceeded.
+	row       int
+	budgetErr *error
+}
+
+func (d resultDecryptor) decrypt(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return d.decrypt(v.Elem())
+	case reflect.Map:
+		return d.decryptMap(v)
+	case reflect.Struct:
+		if !v.CanAddr() {
+			return nil
+		}
+		if _, ok := v.Addr().Interface().(sql.Scanner); !ok {
+			return d.decryptStruct(v)
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		for i := 0; i < v.Len(); i++ {
+			elem := d
+			elem.row = i
+			if err := elem.decrypt(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// A plain value, which holds the single column selected.
+	if field := d.encryptedField(d.column); field != nil && v.CanSet() {
+		return d.decryptValue(field, v)
+	}
+	return nil
+}
+
+func (d resultDecryptor) decryptMap(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.Interface {
+		return nil
+	}
+
+	iter := v.MapRange()
+	for iter.Next() {
+		field := d.encryptedField(iter.Key().String())
+		if field == nil || iter.Value().IsNil() {
+			continue
+		}
+		value := reflect.New(iter.Value().Elem().Type()).Elem()
+		value.Set(iter.Value().Elem())
+		if err := d.decryptValue(field, value); err != nil {
+			return err
+		}
+		v.SetMapIndex(iter.Key(), value)
+	}
+	return nil
+}
+
+func (d resultDecryptor) decryptStruct(v reflect.Value) error {
+	if v.Type() == d.schema.ModelType {
+		return nil
+	}
+
+	stmt := &gorm.Statement{DB: d.db}
+	if err := stmt.Parse(v.Addr().Interface()); err != nil {
+		return err
+	}
+	for _, dtoField := range stmt.Schema.Fields {
+		if dtoField.DBName == "" || isEncrypted(dtoField) {
+			continue
+		}
+		field := d.encryptedField(dtoField.DBName)
+		if field == nil {
+			continue
+		}
+		fv, ok := fieldByIndex(v, dtoField.StructField.Index)
+		if !ok {
+			continue
+		}
+		if err := d.decryptValue(field, fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptedField returns the encrypted field with the provided column, optionally qualified by a table name. Columns qualified by the table of the
+// schema, or not qualified and found in the schema, are looked up in the schema only, so that the plaintext columns of the model are never mistaken
+// for the encrypted columns of its relationships. Other columns are looked up in the schemas of the relationships whose name or table qualifies
+// them, or of the joined relationships if they are not qualified. Unqualified columns that are ambiguous are ignored.
+func (d resultDecryptor) encryptedField(column string) *schema.Field {
+	if column == "" {
+		return nil
+	}
+	if aliased, ok := d.aliases[column]; ok {
+		column = aliased
+	}
+	table, name, qualified := strings.Cut(column, ".")
+	if !qualified {
+		table, name = "", column
+	}
+	table, name = strings.Trim(table, "`\""), strings.Trim(name, "`\"")
+
+	if table == d.schema.Table || table == "" && d.schema.LookUpField(name) != nil {
+		return lookUpEncrypted(d.schema, "", name)
+	}
+
+	var found *schema.Field
+	for relationName, relation := range d.schema.Relationships.Relations {
+		if table == "" && !d.joins[relationName] || table != "" && table != relationName && table != relation.FieldSchema.Table {
+			continue
+		}
+		if field := lookUpEncrypted(relation.FieldSchema, "", name); field != nil {
+			if found != nil && found != field {
+				return nil
+			}
+			found = field
+		}
+	}
+	return found
+}
+
+// lookUpEncrypted returns the encrypted field of sch with the provided name, if the table matches.
+func lookUpEncrypted(sch *schema.Schema, table, name string) *schema.Field {
+	if table != "" && table != sch.Table {
+		return nil
+	}
+	field := sch.LookUpField(name)
+	if field == nil || !isEncrypted(field) {
+		return nil
+	}
+	return field
+}
+
+// decryptValue decrypts the value held by v, which was read from the column of the encrypted field, and replaces it with the plaintext. Empty values
+// are left as they are, as they are not encrypted.
+func (d resultDecryptor) decryptValue(field *schema.Field, v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.IsZero() {
+		return nil
+	}
+
+	serializer := field.Serializer.(D1Serializer)
+	if fields, ok := decryptOnlyFromContext(d.ctx); ok && !fields.includes(field) {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	var stored interface{}
+	switch value := v.Interface().(type) {
+	case string, []byte:
+		stored = value
+	case secretValue:
+		stored = value.exposed()
+	default:
+		return newFieldError(d.ctx, OperationDecrypt, field, reflect.Value{},
+			fmt.Errorf("decryption of type %T: %w", value, ErrDecryptUnsupported))
+	}
+
+	var ciphertext []byte
+	switch value := stored.(type) {
+	case []byte:
+		ciphertext = value
+	case string:
+		var err error
+		if ciphertext, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return d.decryptFailed(field, v, err)
+		}
+	}
+
+	if scope, ok := statementScopeFromContext(d.ctx); ok {
+		allowed, err := scope.reserveDecrypt()
+		if !allowed {
+			if err != nil {
+				*d.budgetErr = err
+			}
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+	}
+
+	plaintext, err := serializer.decrypt(d.ctx, field, reflect.Value{}, ciphertext)
+	if err != nil {
+		return d.decryptFailed(field, v, err)
+	}
+	return setPlaintext(v, plaintext)
+}
+
+// decryptFailed handles a value that could not be decrypted according to the decryption error policy of the statement.
+func (d resultDecryptor) decryptFailed(field *schema.Field, v reflect.Value, err error) error {
+	return withholdFailed(d.ctx, field, reflect.Value{}, d.row, err, func(mask []byte) error {
+		if mask == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		return setPlaintext(v, mask)
+	})
+}
+
+// setPlaintext sets the string, []byte or Secret value v to plaintext.
+func setPlaintext(v reflect.Value, plaintext []byte) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(plaintext))
+	case reflect.Slice:
+		v.SetBytes(plaintext)
+	default:
+		return v.Addr().Interface().(sql.Scanner).Scan(plaintext)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+type PersonDTO struct {
+	ID       int
+	LastName string
+	Notes    *[]byte
+}
+
+type PersonSecretDTO struct {
+	FirstName string
+	LastName  Secret[string]
+}
+
+func newResultsTestDB(t *testing.T) *gorm.DB {
+	db := newGuardTestDB(t)
+	err := db.Create(&PersonGuard{2, "Jane", "Roe", nil}).Error
+	assert.Nil(t, err)
+	return db
+}
+
+func TestDecryptQueryResults(t *testing.T) {
+	db := newResultsTestDB(t)
+	notes := []byte("note")
+
+	var maps []map[string]interface{}
+	err := db.Model(&PersonGuard{}).Order("id").Find(&maps).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"id": 1, "first_name": "John", "last_name": "Doe", "notes": notes},
+		{"id": 2, "first_name": "Jane", "last_name": "Roe", "notes": nil},
+	}, maps)
+
+	single := map[string]interface{}{}
+	err = db.Model(&PersonGuard{}).Take(&single, 1).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "Doe", single["last_name"])
+
+	var lastNames []string
+	err = db.Model(&PersonGuard{}).Order("id").Pluck("last_name", &lastNames).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Doe", "Roe"}, lastNames)
+
+	var firstNames []string
+	err = db.Model(&PersonGuard{}).Order("id").Pluck("FirstName", &firstNames).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"John", "Jane"}, firstNames)
+
+	var dtos []PersonDTO
+	err = db.Model(&PersonGuard{}).Order("id").Find(&dtos).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []PersonDTO{{1, "Doe", &notes}, {2, "Roe", nil}}, dtos)
+
+	var secrets []PersonSecretDTO
+	err = db.Model(&PersonGuard{}).Order("id").Find(&secrets).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "Doe", secrets[0].LastName.Expose())
+
+	// The values are not decrypted without decryption
+	err = db.WithContext(WithoutDecryption(db.Statement.Context)).Model(&PersonGuard{}).Order("id").Pluck("last_name", &lastNames).Error
+	assert.Nil(t, err)
+	assert.Equal(t, []string{encryptedLastName("Doe"), encryptedLastName("Roe")}, lastNames)
+}
+
+func TestDecryptQueryResultsBudget(t *testing.T) {
+	db := newResultsTestDB(t)
+
+	var maps []map[string]interface{}
+	tx := db.Set(MaxDecryptsSetting, 2).Model(&PersonGuard{}).Order("id").Find(&maps)
+	assert.ErrorIs(t, tx.Error, ErrDecryptBudgetExceeded)
+	assert.Equal(t, "Doe", maps[0]["last_name"])
+	assert.Equal(t, []byte("note"), maps[0]["notes"])
+	assert.Equal(t, "", maps[1]["last_name"])
+
+	var lastNames []string
+	tx = db.Set(MaxDecryptsSetting, 1).Model(&PersonGuard{}).Order("id").Pluck("last_name", &lastNames)
+	assert.ErrorIs(t, tx.Error, ErrDecryptBudgetExceeded)
+	assert.Equal(t, []string{"Doe", ""}, lastNames)
+	stats, ok := StatementStatsFromContext(tx.Statement.Context)
+	assert.True(t, ok)
+	assert.Equal(t, 1, stats.Decrypts)
+}
+
+func TestDecryptQueryResultsPolicy(t *testing.T) {
+	db := newResultsTestDB(t)
+	err := db.Exec("UPDATE person_guards SET last_name = ? WHERE id = 2", "not base64").Error
+	assert.Nil(t, err)
+
+	var lastNames []string
+	tx := db.Model(&PersonGuard{}).Order("id").Pluck("last_name", &lastNames)
+	assert.NotNil(t, tx.Error)
+
+	tx = db.Set(DecryptErrorPolicySetting, DecryptErrorMask).Model(&PersonGuard{}).Order("id").Pluck("last_name", &lastNames)
+	assert.Nil(t, tx.Error)
+	assert.Equal(t, []string{"Doe", redacted}, lastNames)
+	assert.Len(t, DecryptErrors(tx), 1)
+
+	var dtos []PersonDTO
+	tx = db.Set(DecryptErrorPolicySetting, DecryptErrorDropRow).Model(&PersonGuard{}).Order("id").Find(&dtos)
+	assert.Nil(t, tx.Error)
+	assert.Len(t, dtos, 1)
+	assert.Equal(t, "Doe", dtos[0].LastName)
+}
+
+func TestDecryptScannedResults(t *testing.T) {
+	db := newResultsTestDB(t)
+
+	dto := PersonDTO{}
+	tx := db.Model(&PersonGuard{}).Where("id = ?", 1).Scan(&dto)
+	assert.Nil(t, tx.Error)
+	assert.Equal(t, encryptedLastName("Doe"), dto.LastName)
+	err := DecryptResults(tx, &dto)
+	assert.Nil(t, err)
+	assert.Equal(t, "Doe", dto.LastName)
+	assert.Equal(t, []byte("note"), *dto.Notes)
+
+	tx = db.Model(&PersonGuard{}).Order("id")
+	rows, err := tx.Rows()
+	assert.Nil(t, err)
+	defer rows.Close()
+
+	var dtos []PersonDTO
+	for rows.Next() {
+		dto := PersonDTO{}
+		err = tx.ScanRows(rows, &dto)
+		assert.Nil(t, err)
+		dtos = append(dtos, dto)
+	}
+	err = DecryptResults(tx, &dtos)
+	assert.Nil(t, err)
+	assert.Equal(t, "Doe", dtos[0].LastName)
+	assert.Equal(t, "Roe", dtos[1].LastName)
+}
+
+func TestScanUndecryptedRows(t *testing.T) {
+	db := newResultsTestDB(t)
+
+	// Encrypted columns are not scanned silently from a single row
+	var lastName string
+	err := db.Model(&PersonGuard{}).Select("last_name").Where("id = ?", 1).Row().Scan(&lastName)
+	assert.ErrorIs(t, err, ErrUndecryptedRows)
+	assert.Empty(t, lastName)
+
+	// Unencrypted columns, and rows read without decryption or accepted undecrypted, can be scanned
+	var firstName string
+	err = db.Model(&PersonGuard{}).Select("first_name").Where("id = ?", 1).Row().Scan(&firstName)
+	assert.Nil(t, err)
+	assert.Equal(t, "John", firstName)
+
+	err = db.WithContext(WithoutDecryption(context.Background())).Model(&PersonGuard{}).Select("last_name").Where("id = ?", 1).Row().Scan(&lastName)
+	assert.Nil(t, err)
+	assert.Equal(t, encryptedLastName("Doe"), lastName)
+
+	err = db.WithContext(ScanUndecrypted(context.Background())).Model(&PersonGuard{}).Select("last_name").Where("id = ?", 1).Row().Scan(&lastName)
+	assert.Nil(t, err)
+	assert.Equal(t, encryptedLastName("Doe"), lastName)
+
+	// Rows scanned into the model are decrypted by the D1Serializer
+	person := PersonGuard{}
+	err = db.Model(&PersonGuard{}).Where("id = ?", 1).Scan(&person).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "Doe", person.LastName)
+
+	person = PersonGuard{}
+	err = db.Table("person_guards").Where("id = ?", 1).Scan(&person).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "Doe", person.LastName)
+
+	tx := db.Model(&PersonGuard{}).Where("id = ?", 1)
+	rows, err := tx.Rows()
+	assert.Nil(t, err)
+	defer rows.Close()
+	assert.True(t, rows.Next())
+	person = PersonGuard{}
+	err = tx.ScanRows(rows, &person)
+	assert.Nil(t, err)
+	assert.Equal(t, "Doe", person.LastName)
+}
+
+type PersonFound struct {
+	ID       int
+	LastName string `gorm:"serializer:D1"`
+}
+
+func (PersonFound) TableName() string {
+	return "person_guards"
+}
+
+func (PersonFound) AfterFind(*gorm.DB) error {
+	return nil
+}
+
+type PersonFoundDTO struct {
+	LastName string
+	found    string
+}
+
+func (p *PersonFoundDTO) AfterFind(*gorm.DB) error {
+	p.found = p.LastName
+	return nil
+}
+
+func TestDecryptResultsBeforeAfterFind(t *testing.T) {
+	db := newResultsTestDB(t)
+
+	dto := PersonFoundDTO{}
+	err := db.Model(&PersonFound{}).Where("id = ?", 1).Find(&dto).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "Doe", dto.LastName)
+	assert.Equal(t, "Doe", dto.found)
+}
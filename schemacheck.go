@@ -0,0 +1,184 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Errors matched by the ColumnErrors reported by CheckSchema.
+var (
+	// ErrColumnMissing is matched when the column of an encrypted field does not exist.
+	ErrColumnMissing = fmt.Errorf("the column does not exist")
+	// ErrColumnTooShort is matched when the column of an encrypted field is shorter than its largest ciphertext, which the database would truncate
+	// or reject.
+	ErrColumnTooShort = fmt.Errorf("the column is too short for the ciphertext")
+	// ErrColumnType is matched when the type of the column of an encrypted field cannot hold its ciphertext, e.g. a character column for a []byte
+	// field whose ciphertext is binary.
+	ErrColumnType = fmt.Errorf("the type of the column does not suit the ciphertext")
+	// ErrColumnCollation is matched when the collation of the column of an encrypted field does not suit its ciphertext, e.g. a case-insensitive
+	// collation for base64 encoded ciphertexts.
+	ErrColumnCollation = fmt.Errorf("the collation of the column does not suit the ciphertext")
+)
+
+// ColumnError describes a column that cannot hold the ciphertexts of its encrypted field, as reported by CheckSchema. It wraps one of
+// ErrColumnMissing, ErrColumnTooShort, ErrColumnType and ErrColumnCollation.
+type ColumnError struct {
+	Table  string
+	Column string
+	Err    error
+}
+
+func (e *ColumnError) Error() string {
+	return fmt.Sprintf("column %s.%s: %v", e.Table, e.Column, e.Err)
+}
+
+// Unwrap returns the cause of the error.
+func (e *ColumnError) Unwrap() error {
+	return e.Err
+}
+
+// Database types that hold binary ciphertexts and base64 encoded ciphertexts, as reported by the dialects.
+var (
+	binaryColumnTypes = map[string]bool{
+		"binary": true, "varbinary": true, "tinyblob": true, "blob": true, "mediumblob": true, "longblob": true, "bytea": true, "image": true,
+	}
+	textColumnTypes = map[string]bool{
+		"char": true, "varchar": true, "tinytext": true, "text": true, "mediumtext": true, "longtext": true, "character": true,
+		"character varying": true, "bpchar": true, "nchar": true, "nvarchar": true, "ntext": true, "clob": true,
+	}
+)
+
+// unboundedColumnLength is the length a column must have to hold the ciphertexts of a field without a maximum plaintext size.
+const unboundedColumnLength = 1 << 24
+
+// CheckSchema checks that the existing columns of the fields of the models tagged with `gorm:"serializer:D1"` can hold their ciphertexts, for the
+// databases that are not migrated with AutoMigrate. It compares the type and length reported by db.Migrator().ColumnTypes, and the collation on
+// the dialects that report it, with the ciphertexts of each field: binary for []byte fields and base64 encoded for string fields, and up to the
+// size derived from the maximum plaintext size set with the d1 tag, e.g. `d1:"size=64"`. Fields without a maximum plaintext size need columns of
+// unbounded length. SQLite columns accept values of any type and length, so only missing columns are reported for it.
+//
+// The columns that cannot hold the ciphertexts are returned as *ColumnErrors. The error is only set if the schema cannot be read.
+func CheckSchema(db *gorm.DB, models ...interface{}) ([]*ColumnError, error) {
+	var columnErrors []*ColumnError
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return nil, err
+		}
+
+		columns := map[string]gorm.ColumnType{}
+		var collations map[string]string
+		if db.Migrator().HasTable(model) {
+			columnTypes, err := db.Migrator().ColumnTypes(model)
+			if err != nil {
+				return nil, err
+			}
+			for _, columnType := range columnTypes {
+				columns[columnType.Name()] = columnType
+			}
+			if collations, err = columnCollations(db, stmt.Table); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, field := range stmt.Schema.Fields {
+			serializer, ok := field.Serializer.(D1Serializer)
+			if !ok || field.DBName == "" {
+				continue
+			}
+			text, ok := storedAsText(field.IndirectFieldType)
+			if !ok {
+				continue
+			}
+
+			column, ok := columns[field.DBName]
+			if !ok {
+				columnErrors = append(columnErrors, &ColumnError{Table: stmt.Table, Column: field.DBName, Err: ErrColumnMissing})
+				continue
+			}
+			size, bounded := serializer.maxStoredSize(field, text)
+			if err := checkColumn(db.Dialector.Name(), column, collations[field.DBName], text, size, bounded); err != nil {
+				columnErrors = append(columnErrors, &ColumnError{Table: stmt.Table, Column: field.DBName, Err: err})
+			}
+		}
+	}
+	return columnErrors, nil
+}
+
+// checkColumn checks that a column of a dialect can hold ciphertexts of up to size bytes, if bounded, which are base64 encoded if text is true.
+func checkColumn(dialect string, column gorm.ColumnType, collation string, text bool, size int, bounded bool) error {
+	if dialect == "sqlite" {
+		return nil
+	}
+
+	databaseType := strings.ToLower(column.DatabaseTypeName())
+	switch {
+	case !text && !binaryColumnTypes[databaseType]:
+		return fmt.Errorf("%w: %s cannot hold binary ciphertexts", ErrColumnType, databaseType)
+	case text && !textColumnTypes[databaseType] && !(dialect == "mysql" && binaryColumnTypes[databaseType]):
+		return fmt.Errorf("%w: %s cannot hold base64 encoded ciphertexts", ErrColumnType, databaseType)
+	}
+
+	if length, ok := column.Length(); ok && length > 0 {
+		switch {
+		case bounded && length < int64(size):
+			return fmt.Errorf("%w: it holds %d bytes and the ciphertexts take up to %d", ErrColumnTooShort, length, size)
+		case !bounded && length < unboundedColumnLength:
+			return fmt.Errorf("%w: it holds %d bytes and the field has no maximum plaintext size, see the size setting of the d1 tag",
+				ErrColumnTooShort, length)
+		}
+	}
+
+	// base64 is case-sensitive, so case-insensitive collations compare distinct ciphertexts as equal.
+	if lower := strings.ToLower(collation); text && (strings.Contains(lower, "_ci") || strings.Contains(lower, "nocase")) {
+		return fmt.Errorf("%w: %s is case-insensitive", ErrColumnCollation, collation)
+	}
+	return nil
+}
+
+// columnCollations returns the collations of the columns of a table, on the dialects that report them.
+func columnCollations(db *gorm.DB, table string) (map[string]string, error) {
+	query := "SELECT column_name AS name, collation_name AS collation FROM information_schema.columns WHERE table_name = ?"
+	switch db.Dialector.Name() {
+	case "mysql":
+		query += " AND table_schema = DATABASE()"
+	case "postgres":
+		query += " AND table_schema = CURRENT_SCHEMA()"
+	case "sqlserver":
+		// The tables of the default schema are found by their name.
+	default:
+		return nil, nil
+	}
+
+	var rows []struct {
+		Name      string
+		Collation *string
+	}
+	if err := db.Session(&gorm.Session{NewDB: true}).Raw(query, table).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	collations := map[string]string{}
+	for _, row := range rows {
+		if row.Collation != nil {
+			collations[row.Name] = *row.Collation
+		}
+	}
+	return collations, nil
+}
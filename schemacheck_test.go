@@ -0,0 +1,170 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/migrator"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type PersonChecked struct {
+	ID        int
+	FirstName string
+	LastName  string `gorm:"serializer:D1" d1:"size=32"`
+	Notes     []byte `gorm:"serializer:D1"`
+}
+
+type PersonCheckedPartial struct {
+	ID        int
+	FirstName string
+	LastName  string
+}
+
+func (PersonCheckedPartial) TableName() string {
+	return "person_checkeds"
+}
+
+func TestCheckSchema(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+	db := testutil.NewTestDB(t)
+
+	// All the encrypted columns of a missing table are missing
+	columnErrors, err := CheckSchema(db, &PersonChecked{})
+	assert.Nil(t, err)
+	assert.Len(t, columnErrors, 2)
+	for _, columnErr := range columnErrors {
+		assert.ErrorIs(t, columnErr, ErrColumnMissing)
+	}
+
+	err = db.AutoMigrate(&PersonCheckedPartial{})
+	assert.Nil(t, err)
+	columnErrors, err = CheckSchema(db, &PersonChecked{})
+	assert.Nil(t, err)
+	assert.Len(t, columnErrors, 1)
+	assert.Equal(t, "person_checkeds", columnErrors[0].Table)
+	assert.Equal(t, "notes", columnErrors[0].Column)
+	assert.EqualError(t, columnErrors[0], "column person_checkeds.notes: the column does not exist")
+
+	err = AutoMigrate(db, &PersonChecked{})
+	assert.Nil(t, err)
+	columnErrors, err = CheckSchema(db, &PersonChecked{})
+	assert.Nil(t, err)
+	assert.Empty(t, columnErrors)
+}
+
+func checkedColumn(databaseType string, length int64) migrator.ColumnType {
+	return migrator.ColumnType{
+		DataTypeValue: sql.NullString{String: databaseType, Valid: true},
+		LengthValue:   sql.NullInt64{Int64: length, Valid: true},
+	}
+}
+
+// columnDefinition matches the column types picked by AutoMigrate, e.g. "varchar(364) CHARACTER SET ascii COLLATE ascii_bin".
+var columnDefinition = regexp.MustCompile(`^(\w+)(?:\((\d+|max)\))?(?: CHARACTER SET \w+)?(?: COLLATE (\w+))?$`)
+
+// createdColumn returns the column type and collation reported by a server for a column created with the provided type, given the default
+// collation of the server.
+func createdColumn(t *testing.T, definition, defaultCollation string) (migrator.ColumnType, string) {
+	match := columnDefinition.FindStringSubmatch(definition)
+	if !assert.NotNil(t, match, definition) {
+		return migrator.ColumnType{}, ""
+	}
+
+	lengths := map[string]int64{"mediumtext": 16777215, "mediumblob": 16777215, "longtext": 4294967295, "longblob": 4294967295}
+	length := lengths[match[1]]
+	if match[2] == "max" {
+		length = -1
+	} else if n, err := strconv.ParseInt(match[2], 10, 64); err == nil {
+		length = n
+	}
+
+	collation := match[3]
+	if collation == "" && textColumnTypes[match[1]] {
+		collation = defaultCollation
+	}
+	return checkedColumn(match[1], length), collation
+}
+
+func TestCheckSchemaAcceptsColumnTypes(t *testing.T) {
+	schema.RegisterSerializer("D1", NewD1Serializer(slowCryptor{}))
+	sch, err := schema.Parse(&PersonColumns{}, &sync.Map{}, schema.NamingStrategy{})
+	assert.Nil(t, err)
+
+	defaultCollations := map[string]string{"mysql": "utf8mb4_0900_ai_ci", "sqlserver": "SQL_Latin1_General_CP1_CI_AS", "postgres": ""}
+	for dialect, defaultCollation := range defaultCollations {
+		db := &gorm.DB{Config: &gorm.Config{Dialector: namedDialector{name: dialect}}}
+		for _, field := range sch.Fields {
+			definition := columnType(db, field)
+			if _, ok := field.TagSettings["TYPE"]; ok || definition == "" {
+				continue
+			}
+
+			column, collation := createdColumn(t, definition, defaultCollation)
+			text, _ := storedAsText(field.IndirectFieldType)
+			size, bounded := field.Serializer.(D1Serializer).maxStoredSize(field, text)
+			err := checkColumn(dialect, column, collation, text, size, bounded)
+			assert.Nil(t, err, "%s %s", dialect, definition)
+		}
+	}
+}
+
+func TestCheckColumn(t *testing.T) {
+	column := checkedColumn
+
+	tests := []struct {
+		dialect   string
+		column    migrator.ColumnType
+		collation string
+		text      bool
+		size      int
+		bounded   bool
+		err       error
+	}{
+		{"mysql", column("varchar", 191), "utf8mb4_bin", true, 100, true, nil},
+		{"mysql", column("varchar", 191), "utf8mb4_bin", true, 400, true, ErrColumnTooShort},
+		{"mysql", column("varchar", 191), "utf8mb4_bin", true, 0, false, ErrColumnTooShort},
+		{"mysql", column("longtext", 4294967295), "utf8mb4_bin", true, 0, false, nil},
+		{"mysql", column("varchar", 191), "utf8mb4_0900_ai_ci", true, 100, true, ErrColumnCollation},
+		{"mysql", column("varbinary", 500), "", true, 400, true, nil},
+		{"mysql", column("varchar", 500), "utf8mb4_bin", false, 400, true, ErrColumnType},
+		{"mysql", column("LONGBLOB", 4294967295), "", false, 0, false, nil},
+		{"mysql", column("int", 0), "", true, 0, false, ErrColumnType},
+		{"postgres", column("bytea", 0), "", false, 0, false, nil},
+		{"postgres", column("text", 0), "", false, 0, false, ErrColumnType},
+		{"postgres", column("bytea", 0), "", true, 0, false, ErrColumnType},
+		{"postgres", column("character varying", 64), "", true, 100, true, ErrColumnTooShort},
+		{"sqlserver", column("varchar", 0), "SQL_Latin1_General_CP1_CI_AS", true, 0, false, ErrColumnCollation},
+		{"sqlserver", column("varbinary", 8000), "", false, 7000, true, nil},
+		{"sqlite", column("integer", 1), "", false, 100, true, nil},
+	}
+	for i, test := range tests {
+		err := checkColumn(test.dialect, test.column, test.collation, test.text, test.size, test.bounded)
+		if test.err == nil {
+			assert.Nil(t, err, "test %d", i)
+		} else {
+			assert.ErrorIs(t, err, test.err, "test %d", i)
+		}
+	}
+}
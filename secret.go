@@ -0,0 +1,117 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Secret holds a plaintext value that is redacted when formatted, logged or marshaled, so that decrypted data does not leak through e.g.
+// log.Printf("%+v", user) or JSON error payloads. The value can only be read with Expose. A Secret field can be tagged with `gorm:"serializer:D1"`
+// to be encrypted by the D1Serializer, in the same format as a string or []byte field.
+type Secret[T string | []byte] struct {
+	value T
+}
+
+// NewSecret creates a new Secret holding the provided value.
+func NewSecret[T string | []byte](value T) Secret[T] {
+	return Secret[T]{value: value}
+}
+
+// Expose returns the value of the Secret.
+func (s Secret[T]) Expose() T {
+	return s.value
+}
+
+// Wipe clears the value of the Secret. The bytes of a []byte value are zeroed, including those of the slices returned by Expose, which share them,
+// while a string value, which is immutable, is only dropped. This is a best effort: copies of the value made by the caller, by the Go runtime or by
+// the database driver are not wiped.
+func (s *Secret[T]) Wipe() {
+	if b, ok := interface{}(s.value).([]byte); ok {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+	var zero T
+	s.value = zero
+}
+
+// String implements fmt.Stringer and returns a redacted value.
+func (s Secret[T]) String() string {
+	return redacted
+}
+
+// GoString implements fmt.GoStringer and returns a redacted value.
+func (s Secret[T]) GoString() string {
+	return redacted
+}
+
+// Format implements fmt.Formatter and writes a redacted value, whatever the verb.
+func (s Secret[T]) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, redacted)
+}
+
+// MarshalJSON implements json.Marshaler and returns a redacted value.
+func (s Secret[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(redacted)
+}
+
+// MarshalText implements encoding.TextMarshaler and returns a redacted value.
+func (s Secret[T]) MarshalText() ([]byte, error) {
+	return []byte(redacted), nil
+}
+
+// Scan implements sql.Scanner, so that Secret fields can also be used without the D1Serializer.
+func (s *Secret[T]) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case []byte:
+		// The driver may reuse the buffer, so the value is copied.
+		s.value = T(append([]byte(nil), value...))
+	case string:
+		s.value = T(value)
+	case nil:
+		var zero T
+		s.value = zero
+	default:
+		return fmt.Errorf("scanning type %T into a secret: %w", value, ErrDecryptUnsupported)
+	}
+	return nil
+}
+
+// Value implements driver.Valuer, so that Secret fields can also be used without the D1Serializer.
+func (s Secret[T]) Value() (driver.Value, error) {
+	return s.exposed(), nil
+}
+
+// GormDBDataType implements gorm's GormDBDataType, so that AutoMigrate creates the column of a Secret field encrypted by the D1Serializer with a
+// type suited to the ciphertext, see AutoMigrate. Other Secret fields get the type of their value.
+func (s Secret[T]) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return columnType(db, field)
+}
+
+// exposed returns the value of the Secret as an interface, which lets the D1Serializer encrypt it.
+func (s Secret[T]) exposed() interface{} {
+	return s.value
+}
+
+// secretValue is implemented by Secret.
+type secretValue interface {
+	exposed() interface{}
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type PersonSecret struct {
+	ID        int
+	FirstName Secret[string]
+	LastName  Secret[string] `gorm:"serializer:D1"`
+	Notes     Secret[[]byte] `gorm:"serializer:D1"`
+}
+
+func TestSecret(t *testing.T) {
+	cryptor := &testutil.CryptorMock{}
+	cryptor.On("Encrypt", mock.Anything, []byte("Doe")).Once().Return([]byte("Doencrypt"), nil)
+	cryptor.On("Encrypt", mock.Anything, []byte("note")).Once().Return([]byte("notencrypt"), nil)
+	cryptor.On("Decrypt", mock.Anything, []byte("Doencrypt")).Once().Return([]byte("Doe"), nil)
+	cryptor.On("Decrypt", mock.Anything, []byte("notencrypt")).Once().Return([]byte("note"), nil)
+	schema.RegisterSerializer("D1", NewD1Serializer(cryptor))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&PersonSecret{})
+	assert.Nil(t, err)
+
+	err = db.Create(&PersonSecret{1, NewSecret("John"), NewSecret("Doe"), NewSecret([]byte("note"))}).Error
+	assert.Nil(t, err)
+
+	person := &PersonSecret{}
+	err = db.First(person).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "John", person.FirstName.Expose())
+	assert.Equal(t, "Doe", person.LastName.Expose())
+	assert.Equal(t, []byte("note"), person.Notes.Expose())
+
+	// The values are redacted when formatted or marshaled
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x"} {
+		formatted := fmt.Sprintf(format, person)
+		assert.NotContains(t, formatted, "John", format)
+		assert.NotContains(t, formatted, "Doe", format)
+		assert.NotContains(t, formatted, "note", format)
+	}
+	assert.Equal(t, redacted, person.LastName.String())
+
+	marshaled, err := json.Marshal(person)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"ID":1,"FirstName":"[REDACTED]","LastName":"[REDACTED]","Notes":"[REDACTED]"}`, string(marshaled))
+
+	text, err := person.Notes.MarshalText()
+	assert.Nil(t, err)
+	assert.Equal(t, redacted, string(text))
+
+	// Wiping zeroes the underlying buffer
+	notes := person.Notes.Expose()
+	person.Notes.Wipe()
+	assert.Nil(t, person.Notes.Expose())
+	assert.Equal(t, []byte{0, 0, 0, 0}, notes)
+	person.LastName.Wipe()
+	assert.Empty(t, person.LastName.Expose())
+
+	cryptor.AssertExpectations(t)
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// ErrNotWithheld is returned by RevealField when the requested field was not withheld by the statement.
+var ErrNotWithheld = fmt.Errorf("the field was not withheld by the statement")
+
+type decryptOnlyCtxKey struct{}
+
+// decryptOnlyFields is the set of field names that are decrypted by the statements executed with DecryptOnly.
+type decryptOnlyFields map[string]bool
+
+// includes returns true if the field is named either by its Go name or by its database column name.
+func (f decryptOnlyFields) includes(field *schema.Field) bool {
+	return f[field.Name] || f[field.DBName]
+}
+
+// DecryptOnly returns a copy of ctx with which the D1Serializer only decrypts the named fields, so that a statement loading a full model does not
+// pay for, nor expose, the fields the caller does not need. Fields are named by their Go name or their database column name. The other encrypted
+// fields are withheld and left empty. If the Plugin is registered, their ciphertext is retained by the statement and can be decrypted later with
+// RevealField.
+func DecryptOnly(ctx context.Context, fields ...string) context.Context {
+	names := make(decryptOnlyFields, len(fields))
+	for _, field := range fields {
+		names[field] = true
+	}
+	return context.WithValue(ctx, decryptOnlyCtxKey{}, names)
+}
+
+// DecryptOnlyScope returns a gorm scope that only decrypts the named fields, as DecryptOnly does, e.g.
+// db.Scopes(d1gorm.DecryptOnlyScope("Email")).Find(&users).
+func DecryptOnlyScope(fields ...string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		db.Statement.Context = DecryptOnly(db.Statement.Context, fields...)
+		return db
+	}
+}
+
+func decryptOnlyFromContext(ctx context.Context) (decryptOnlyFields, bool) {
+	fields, ok := ctx.Value(decryptOnlyCtxKey{}).(decryptOnlyFields)
+	return fields, ok
+}
+
+// RevealField decrypts the value of a field withheld by DecryptOnly, from the ciphertext retained by the statement that produced tx, and sets it in
+// model. The model must be a pointer to the destination of the statement, or to one of the rows it holds, and name is either the Go name or the
+// database column name of the field. The decryption is performed with ctx. It requires the Plugin to be registered.
+func RevealField(ctx context.Context, tx *gorm.DB, model interface{}, name string) error {
+	scope, ok := statementScopeFromContext(tx.Statement.Context)
+	if !ok || tx.Statement.Schema == nil {
+		return ErrNotWithheld
+	}
+
+	field := tx.Statement.Schema.LookUpField(name)
+	if field == nil {
+		return fmt.Errorf("%w: unknown field %s", ErrNotWithheld, name)
+	}
+	serializer, ok := field.Serializer.(D1Serializer)
+	if !ok {
+		return fmt.Errorf("%w: field %s is not encrypted", ErrNotWithheld, name)
+	}
+
+	dst := reflect.ValueOf(model)
+	row, ok := rowOf(tx.Statement.ReflectValue, dst)
+	if !ok {
+		return fmt.Errorf("%w: the model is not a result of the statement", ErrNotWithheld)
+	}
+
+	scope.mu.Lock()
+	dbValue, ok := scope.withheld[field][row]
+	scope.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: field %s", ErrNotWithheld, name)
+	}
+
+	return serializer.scan(ctx, field, dst.Elem(), dbValue, row)
+}
+
+// rowOf returns the index of the row of the statement results rv that dst points to.
+func rowOf(rv, dst reflect.Value) (int, bool) {
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return 0, false
+	}
+
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if isPointerTo(dst, rv.Index(i)) {
+				return i, true
+			}
+		}
+	case reflect.Struct:
+		if isPointerTo(dst, rv) {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// isPointerTo returns true if ptr points to v, or to the same value as v if v is itself a pointer.
+func isPointerTo(ptr, v reflect.Value) bool {
+	if v.Kind() == reflect.Ptr {
+		return v.Type() == ptr.Type() && !v.IsNil() && v.Pointer() == ptr.Pointer()
+	}
+	return v.CanAddr() && v.Addr().Type() == ptr.Type() && v.Addr().Pointer() == ptr.Pointer()
+}
+
+// withhold retains the value of a field withheld by DecryptOnly.
+func (s *statementScope) withhold(field *schema.Field, row int, dbValue interface{}) {
+	if value, ok := dbValue.([]byte); ok {
+		// The driver may reuse the buffer before the value is revealed, so the value is copied.
+		dbValue = append([]byte(nil), value...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.withheld == nil {
+		s.withheld = map[*schema.Field]map[int]interface{}{}
+	}
+	if s.withheld[field] == nil {
+		s.withheld[field] = map[int]interface{}{}
+	}
+	s.withheld[field][row] = dbValue
+}
+
+// dropWithheld discards the values withheld from the dropped rows, and shifts the rows of the remaining ones accordingly.
+func (s *statementScope) dropWithheld(dropped map[int]bool) {
+	if len(dropped) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for field, rows := range s.withheld {
+		kept := make(map[int]interface{}, len(rows))
+		for row, dbValue := range rows {
+			if dropped[row] {
+				continue
+			}
+			shift := 0
+			for d := range dropped {
+				if d < row {
+					shift++
+				}
+			}
+			kept[row-shift] = dbValue
+		}
+		s.withheld[field] = kept
+	}
+}
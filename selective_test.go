@@ -0,0 +1,134 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type PersonContact struct {
+	ID    int
+	Name  string
+	Email string `gorm:"serializer:D1"`
+	Phone string `gorm:"serializer:D1"`
+}
+
+func newContactTestDB(t *testing.T, opts ...PluginOption) (*gorm.DB, *testutil.CryptorMock) {
+	cryptor := &testutil.CryptorMock{}
+	for _, value := range []string{"john@example.com", "jane@example.com", "1234", "5678"} {
+		cryptor.On("Encrypt", mock.Anything, []byte(value)).Return([]byte(value+"encrypt"), nil)
+		cryptor.On("Decrypt", mock.Anything, []byte(value+"encrypt")).Return([]byte(value), nil)
+	}
+	schema.RegisterSerializer("D1", NewD1Serializer(cryptor))
+
+	db := testutil.NewTestDB(t)
+	err := db.Use(NewPlugin(opts...))
+	assert.Nil(t, err)
+	err = db.AutoMigrate(&PersonContact{})
+	assert.Nil(t, err)
+
+	err = db.Create(&[]PersonContact{{1, "John", "john@example.com", "1234"}, {2, "Jane", "jane@example.com", "5678"}}).Error
+	assert.Nil(t, err)
+	return db, cryptor
+}
+
+func TestDecryptOnly(t *testing.T) {
+	db, cryptor := newContactTestDB(t)
+
+	ctx := context.Background()
+	var people []PersonContact
+	tx := db.WithContext(DecryptOnly(ctx, "Email")).Find(&people)
+	assert.Nil(t, tx.Error)
+	assert.Equal(t, []PersonContact{{1, "John", "john@example.com", ""}, {2, "Jane", "jane@example.com", ""}}, people)
+	cryptor.AssertNumberOfCalls(t, "Decrypt", 2)
+
+	// The withheld fields are decrypted on demand
+	err := RevealField(ctx, tx, &people[1], "Phone")
+	assert.Nil(t, err)
+	assert.Equal(t, PersonContact{2, "Jane", "jane@example.com", "5678"}, people[1])
+	assert.Equal(t, "", people[0].Phone)
+	cryptor.AssertNumberOfCalls(t, "Decrypt", 3)
+
+	err = RevealField(ctx, tx, &people[0], "email")
+	assert.ErrorIs(t, err, ErrNotWithheld)
+	err = RevealField(ctx, tx, &PersonContact{}, "Phone")
+	assert.ErrorIs(t, err, ErrNotWithheld)
+
+	// The fields can be selected with a scope, by column name
+	person := &PersonContact{}
+	tx = db.Scopes(DecryptOnlyScope("phone")).First(person)
+	assert.Nil(t, tx.Error)
+	assert.Equal(t, PersonContact{1, "John", "", "1234"}, *person)
+	cryptor.AssertNumberOfCalls(t, "Decrypt", 4)
+
+	err = RevealField(ctx, tx, person, "Email")
+	assert.Nil(t, err)
+	assert.Equal(t, PersonContact{1, "John", "john@example.com", "1234"}, *person)
+}
+
+func TestDecryptOnlyDropRow(t *testing.T) {
+	db, cryptor := newContactTestDB(t, WithDecryptErrorPolicy(DecryptErrorDropRow))
+	cryptor.ExpectedCalls = nil
+	cryptor.On("Decrypt", mock.Anything, []byte("john@example.comencrypt")).Return(nil, status.Error(codes.PermissionDenied, "denied"))
+	for _, value := range []string{"jane@example.com", "5678"} {
+		cryptor.On("Decrypt", mock.Anything, []byte(value+"encrypt")).Return([]byte(value), nil)
+	}
+
+	// The withheld values follow their rows when others are dropped
+	ctx := context.Background()
+	var people []*PersonContact
+	tx := db.WithContext(DecryptOnly(ctx, "Email")).Find(&people)
+	assert.Nil(t, tx.Error)
+	assert.Len(t, people, 1)
+
+	err := RevealField(ctx, tx, people[0], "Phone")
+	assert.Nil(t, err)
+	assert.Equal(t, PersonContact{2, "Jane", "jane@example.com", "5678"}, *people[0])
+}
+
+func TestDecryptOnlyReusedBuffer(t *testing.T) {
+	type PersonNotes struct {
+		ID    int
+		Notes []byte `gorm:"serializer:D1"`
+	}
+
+	serializer := NewD1Serializer(slowCryptor{})
+	schema.RegisterSerializer("D1", serializer)
+	sch, err := schema.Parse(&PersonNotes{}, &sync.Map{}, schema.NamingStrategy{})
+	assert.Nil(t, err)
+	field := sch.LookUpField("Notes")
+
+	// The driver reuses its buffer for the next row before the withheld value is revealed
+	scope := &statementScope{}
+	ctx := context.WithValue(DecryptOnly(context.Background(), "ID"), statementScopeCtxKey{}, scope)
+	buffer := []byte("encrypted:note")
+	err = serializer.Scan(ctx, field, reflect.ValueOf(&PersonNotes{}).Elem(), buffer)
+	assert.Nil(t, err)
+	copy(buffer, "encrypted:next")
+
+	assert.Equal(t, []byte("encrypted:note"), scope.withheld[field][0])
+}
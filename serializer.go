@@ -19,6 +19,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/cybercryptio/d1-gorm/crypto"
 	"gorm.io/gorm/schema"
@@ -32,40 +34,90 @@ var ErrDecryptUnsupported = fmt.Errorf("supported decryption field types: string
 
 // D1Serializer is used to transparently encrypt and decrypt data when reading/writing to the database. To use it you must instantiate it, register it
 // to be used for your gorm schema with schema.RegisterSerializer("D1", d1Serializer), and tag the model fields to be serialized with
-// `gorm:"serializer:D1"`. Currently only the serialization of string and []byte data types is supported.
+// `gorm:"serializer:D1"`. Currently only the serialization of string and []byte data types is supported, as well as Encrypted and Secret values of
+// them.
 type D1Serializer struct {
 	cryptor crypto.Cryptor
+	opts    serializerOptions
 }
 
 // NewD1Serializer creates a new D1Serializer that uses the provided Cryptor to encrypt and decrypt data.
-func NewD1Serializer(cryptor crypto.Cryptor) D1Serializer {
-	return D1Serializer{cryptor: cryptor}
+func NewD1Serializer(cryptor crypto.Cryptor, opts ...SerializerOption) D1Serializer {
+	o := defaultSerializerOptions()
+	o.apply(opts...)
+
+	return D1Serializer{cryptor: cryptor, opts: o}
 }
 
-// Value is called by gorm to serialize the value of a field before being written to the database.
+// Value is called by gorm to serialize the value of a field before being written to the database. Errors are returned as a *FieldError.
 func (s D1Serializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	if secret, ok := fieldValue.(secretValue); ok {
+		fieldValue = secret.exposed()
+	}
+
 	switch value := fieldValue.(type) {
+	case lazyValue:
+		return s.lazyValue(ctx, field, dst, value)
 	case []byte:
-		encryptedValue, err := s.cryptor.Encrypt(ctx, value)
+		if isWithoutEncryption(ctx) {
+			return value, nil
+		}
+		encryptedValue, err := s.encrypt(ctx, field, dst, value)
 		if err != nil {
-			return nil, err
+			return nil, newFieldError(ctx, OperationEncrypt, field, dst, err)
 		}
 		return encryptedValue, nil
 	case string:
-		encryptedValue, err := s.cryptor.Encrypt(ctx, []byte(value))
+		if isWithoutEncryption(ctx) {
+			return value, nil
+		}
+		encryptedValue, err := s.encrypt(ctx, field, dst, []byte(value))
 		if err != nil {
-			return nil, err
+			return nil, newFieldError(ctx, OperationEncrypt, field, dst, err)
 		}
 		return base64.StdEncoding.EncodeToString(encryptedValue), nil
 	case nil:
 		return nil, nil
 	default:
-		return nil, fmt.Errorf("encryption of type %T: %w", value, ErrEncryptUnsupported)
+		return nil, newFieldError(ctx, OperationEncrypt, field, dst, fmt.Errorf("encryption of type %T: %w", value, ErrEncryptUnsupported))
 	}
 }
 
-// Scan is called by gorm to deserialize the value of a field after it has been read from the database.
+// Scan is called by gorm to deserialize the value of a field after it has been read from the database. Errors are returned as a *FieldError, except
+// for ErrDecryptBudgetExceeded. Values that cannot be decrypted are handled according to the decryption error policy of the statement, and the
+// fields not selected with DecryptOnly are withheld.
 func (s D1Serializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	row := 0
+	if scope, ok := statementScopeFromContext(ctx); ok {
+		row = scope.nextRow(field)
+	}
+
+	if scanner, ok := reflect.New(field.FieldType).Interface().(lazyScanner); ok {
+		return s.scanLazy(ctx, field, dst, dbValue, scanner)
+	}
+
+	if isWithoutDecryption(ctx) {
+		switch value := dbValue.(type) {
+		case []byte:
+			// The driver may reuse the buffer for the next row, so the value is copied.
+			return field.Set(ctx, dst, append([]byte(nil), value...))
+		case string, nil:
+			return field.Set(ctx, dst, dbValue)
+		}
+	}
+
+	if fields, ok := decryptOnlyFromContext(ctx); ok && dbValue != nil && !fields.includes(field) {
+		if scope, ok := statementScopeFromContext(ctx); ok {
+			scope.withhold(field, row, dbValue)
+		}
+		return field.Set(ctx, dst, nil)
+	}
+
+	return s.scan(ctx, field, dst, dbValue, row)
+}
+
+// scan decrypts the value read from the database, and sets the field to the plaintext.
+func (s D1Serializer) scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}, row int) error {
 	var valueBytes []byte
 	var err error
 
@@ -75,18 +127,163 @@ func (s D1Serializer) Scan(ctx context.Context, field *schema.Field, dst reflect
 	case string:
 		valueBytes, err = base64.StdEncoding.DecodeString(value)
 		if err != nil {
-			return err
+			return decryptFailed(ctx, field, dst, row, err)
 		}
 	case nil:
 		return field.Set(ctx, dst, nil)
 	default:
-		return fmt.Errorf("decryption of type %T: %w", value, ErrDecryptUnsupported)
+		return newFieldError(ctx, OperationDecrypt, field, dst, fmt.Errorf("decryption of type %T: %w", value, ErrDecryptUnsupported))
+	}
+
+	if scope, ok := statementScopeFromContext(ctx); ok {
+		allowed, err := scope.reserveDecrypt()
+		if !allowed {
+			// Clear the field, which may hold the value of a previously scanned row.
+			if setErr := field.Set(ctx, dst, nil); setErr != nil {
+				return setErr
+			}
+			return err
+		}
 	}
 
-	decryptedValue, err := s.cryptor.Decrypt(ctx, valueBytes)
+	decryptedValue, err := s.decrypt(ctx, field, dst, valueBytes)
 	if err != nil {
-		return err
+		return decryptFailed(ctx, field, dst, row, err)
 	}
 
 	return field.Set(ctx, dst, decryptedValue)
 }
+
+// lazyValue serializes an Encrypted value. Its plaintext is only encrypted if it was set, otherwise the ciphertext it was read with is written back.
+func (s D1Serializer) lazyValue(ctx context.Context, field *schema.Field, dst reflect.Value, value lazyValue) (interface{}, error) {
+	ciphertext, modified := value.pending()
+	if !modified {
+		ciphertext = value.stored()
+	} else if !isWithoutEncryption(ctx) {
+		var err error
+		if ciphertext, err = s.encrypt(ctx, field, dst, ciphertext); err != nil {
+			return nil, newFieldError(ctx, OperationEncrypt, field, dst, err)
+		}
+	}
+
+	if value.isText() {
+		return base64.StdEncoding.EncodeToString(ciphertext), nil
+	}
+	return ciphertext, nil
+}
+
+// scanLazy sets an Encrypted field to the ciphertext read from the database, without decrypting it.
+func (s D1Serializer) scanLazy(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}, scanner lazyScanner) error {
+	var ciphertext []byte
+	switch value := dbValue.(type) {
+	case []byte:
+		// The driver may reuse the buffer before the value is revealed, so the ciphertext is copied.
+		ciphertext = append([]byte(nil), value...)
+	case string:
+		var err error
+		if ciphertext, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return newFieldError(ctx, OperationDecrypt, field, dst, err)
+		}
+	case nil:
+		return field.Set(ctx, dst, nil)
+	default:
+		return newFieldError(ctx, OperationDecrypt, field, dst, fmt.Errorf("decryption of type %T: %w", value, ErrDecryptUnsupported))
+	}
+
+	scanner.load(s, fieldInfo(ctx, field, dst), ciphertext)
+	return field.Set(ctx, dst, reflect.ValueOf(scanner).Elem().Interface())
+}
+
+// encrypt calls the Cryptor to encrypt the value of the field, and records the call in the statement scope, if any. It returns the value to store,
+// whose header records how the plaintext was transformed before being encrypted.
+func (s D1Serializer) encrypt(ctx context.Context, field *schema.Field, dst reflect.Value, plaintext []byte) ([]byte, error) {
+	if s.opts.err != nil {
+		return nil, s.opts.err
+	}
+	padding, err := paddingOf(field, s.opts.padding)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte
+	if s.opts.compressThreshold > 0 && len(plaintext) >= s.opts.compressThreshold {
+		compressed, err := compress(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		// Values that do not shrink, such as already compressed data, are stored uncompressed.
+		if len(compressed) < len(plaintext) {
+			plaintext = compressed
+			flags |= flagCompressed
+		}
+	}
+	if padding.enabled {
+		plaintext = padding.pad(plaintext)
+		flags |= flagPadded
+	}
+
+	start := time.Now()
+	ciphertext, err := s.cryptor.Encrypt(fieldContext(ctx, field, dst), plaintext)
+	if scope, ok := statementScopeFromContext(ctx); ok {
+		scope.recordEncrypt(time.Since(start))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wrapEnvelope(flags, ciphertext), nil
+}
+
+// decrypt calls the Cryptor to decrypt the stored value of the field, and records the call in the statement scope, if any.
+func (s D1Serializer) decrypt(ctx context.Context, field *schema.Field, dst reflect.Value, stored []byte) ([]byte, error) {
+	start := time.Now()
+	plaintext, err := s.decryptStored(fieldContext(ctx, field, dst), stored)
+	if scope, ok := statementScopeFromContext(ctx); ok {
+		scope.recordDecrypt(time.Since(start))
+	}
+	return plaintext, err
+}
+
+// newFieldError wraps an error that occurred while serializing a field in a FieldError.
+func newFieldError(ctx context.Context, operation Operation, field *schema.Field, dst reflect.Value, err error) *FieldError {
+	fieldErr := &FieldError{Column: field.DBName, Operation: operation, Err: err}
+	if field.Schema != nil {
+		fieldErr.Table = field.Schema.Table
+		fieldErr.PrimaryKey = primaryKey(ctx, field.Schema, dst)
+	}
+	return fieldErr
+}
+
+// fieldContext attaches the information about the field being serialized to the context passed to the Cryptor.
+func fieldContext(ctx context.Context, field *schema.Field, dst reflect.Value) context.Context {
+	return crypto.ContextWithFieldInfo(ctx, fieldInfo(ctx, field, dst))
+}
+
+// fieldInfo returns the information about the field being serialized.
+func fieldInfo(ctx context.Context, field *schema.Field, dst reflect.Value) crypto.FieldInfo {
+	info := crypto.FieldInfo{Column: field.DBName}
+	if field.Schema != nil {
+		info.Table = field.Schema.Table
+		info.PrimaryKey = primaryKey(ctx, field.Schema, dst)
+	}
+	return info
+}
+
+// primaryKey returns the primary key of the row held by dst, or an empty string if it is not set.
+func primaryKey(ctx context.Context, sch *schema.Schema, dst reflect.Value) string {
+	if v := reflect.Indirect(dst); !v.IsValid() || v.Type() != sch.ModelType {
+		return ""
+	}
+
+	keys := make([]string, 0, len(sch.PrimaryFields))
+	for _, field := range sch.PrimaryFields {
+		if field.Serializer != nil {
+			return ""
+		}
+		value, zero := field.ValueOf(ctx, dst)
+		if zero {
+			return ""
+		}
+		keys = append(keys, fmt.Sprint(value))
+	}
+	return strings.Join(keys, ",")
+}
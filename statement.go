@@ -0,0 +1,179 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// StatementStats holds the number of encryptions and decryptions performed by the D1Serializer during a single statement, and the total time spent
+// in the Cryptor.
+type StatementStats struct {
+	Encrypts int
+	Decrypts int
+	Duration time.Duration
+}
+
+// statementScope holds the state of a single statement. It is attached to the statement context by the Plugin, and updated by the D1Serializer.
+type statementScope struct {
+	statement *gorm.Statement
+	// outer is the scope of the statement that triggered this one, e.g. when preloading associations.
+	outer       *statementScope
+	maxDecrypts int
+	policy      DecryptErrorPolicy
+	mask        string
+
+	mu    sync.Mutex
+	stats StatementStats
+	// decrypts is the number of decryptions attempted, and budgetExceeded is set once the decryption budget has been exceeded.
+	decrypts       int
+	budgetExceeded bool
+	// rows counts the values scanned for each field, which is the index of the row being scanned.
+	rows map[*schema.Field]int
+	// fieldErrors holds the errors of the fields withheld according to the decryption error policy, and dropped the rows to remove from the results.
+	fieldErrors []*FieldError
+	dropped     map[int]bool
+	// failed holds the rows of the fields withheld according to the decryption error policy, by field.
+	failed map[*schema.Field]map[int]bool
+	// withheld holds the values of the fields withheld by DecryptOnly, by row.
+	withheld map[*schema.Field]map[int]interface{}
+	// written holds the values encrypted by the Plugin before being written without going through the D1Serializer.
+	written []writtenValue
+	// explain returns the SQL of the statement with the encrypted values redacted, and the number of affected rows.
+	explain func() (string, int64)
+}
+
+type statementScopeCtxKey struct{}
+
+// ErrDecryptBudgetExceeded is returned when a statement exceeds the maximum number of decryptions set with WithMaxDecrypts, MaxDecryptsSetting or
+// ContextWithMaxDecrypts. The fields of the rows that were not decrypted are left empty.
+var ErrDecryptBudgetExceeded = fmt.Errorf("the decryption budget of the statement is exceeded")
+
+// MaxDecryptsSetting is the gorm setting used to override the decryption budget of the statements of a session, e.g.
+// db.Set(d1gorm.MaxDecryptsSetting, 100).Find(&users).
+const MaxDecryptsSetting = "d1:max_decrypts"
+
+type maxDecryptsCtxKey struct{}
+
+// ContextWithMaxDecrypts returns a copy of ctx that overrides the decryption budget of the statements executed with it.
+func ContextWithMaxDecrypts(ctx context.Context, maxDecrypts int) context.Context {
+	return context.WithValue(ctx, maxDecryptsCtxKey{}, maxDecrypts)
+}
+
+func statementScopeFromContext(ctx context.Context) (*statementScope, bool) {
+	scope, ok := ctx.Value(statementScopeCtxKey{}).(*statementScope)
+	return scope, ok
+}
+
+// StatementStatsFromContext returns the statistics of the statement whose context is ctx. It returns false if the Plugin is not registered.
+func StatementStatsFromContext(ctx context.Context) (StatementStats, bool) {
+	scope, ok := statementScopeFromContext(ctx)
+	if !ok {
+		return StatementStats{}, false
+	}
+
+	scope.mu.Lock()
+	defer scope.mu.Unlock()
+	return scope.stats, true
+}
+
+// reserveDecrypt reserves a decryption from the budget of the statement. If the budget is exceeded, it returns false, along with
+// ErrDecryptBudgetExceeded the first time only, so that the error is added to the statement once.
+func (s *statementScope) reserveDecrypt() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxDecrypts <= 0 || s.decrypts < s.maxDecrypts {
+		s.decrypts++
+		return true, nil
+	}
+	if s.budgetExceeded {
+		return false, nil
+	}
+	s.budgetExceeded = true
+	return false, fmt.Errorf("%w: the limit is %d decryptions", ErrDecryptBudgetExceeded, s.maxDecrypts)
+}
+
+// nextRow returns the index of the row whose value of field is being scanned.
+func (s *statementScope) nextRow(field *schema.Field) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rows == nil {
+		s.rows = map[*schema.Field]int{}
+	}
+	row := s.rows[field]
+	s.rows[field]++
+	return row
+}
+
+// recordFieldError records the error of a field withheld according to the decryption error policy, in this scope and the outer ones.
+func (s *statementScope) recordFieldError(field *schema.Field, err *FieldError, row int) {
+	s.mu.Lock()
+	s.fieldErrors = append(s.fieldErrors, err)
+	if s.failed == nil {
+		s.failed = map[*schema.Field]map[int]bool{}
+	}
+	if s.failed[field] == nil {
+		s.failed[field] = map[int]bool{}
+	}
+	s.failed[field][row] = true
+	if s.policy == DecryptErrorDropRow {
+		if s.dropped == nil {
+			s.dropped = map[int]bool{}
+		}
+		s.dropped[row] = true
+	}
+	s.mu.Unlock()
+
+	for outer := s.outer; outer != nil; outer = outer.outer {
+		outer.mu.Lock()
+		outer.fieldErrors = append(outer.fieldErrors, err)
+		outer.mu.Unlock()
+	}
+}
+
+// undecrypted returns whether the value of field in the given row was withheld by DecryptOnly or according to the decryption error policy, and
+// therefore does not hold plaintext. Rows are counted before the dropped rows are removed from the results.
+func (s *statementScope) undecrypted(field *schema.Field, row int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failed[field][row] {
+		return true
+	}
+	_, ok := s.withheld[field][row]
+	return ok
+}
+
+func (s *statementScope) recordEncrypt(duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Encrypts++
+	s.stats.Duration += duration
+}
+
+func (s *statementScope) recordDecrypt(duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Decrypts++
+	s.stats.Duration += duration
+}
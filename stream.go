@@ -0,0 +1,195 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// Error returned by DecryptStream when the stream ends before its final chunk.
+var ErrStreamTruncated = fmt.Errorf("the encrypted stream is truncated")
+
+// streamMagic starts the streams written by EncryptStream, and is followed by the version of the format, the chunk size and the stream ID.
+var streamMagic = []byte{0x00, 'd', '1', 's'}
+
+const (
+	streamVersion = 1
+	// streamIDLength is the length of the random ID that binds the chunks to their stream.
+	streamIDLength = 16
+	// streamHeaderLength is the length of the header of a stream: the magic, the version, the chunk size and the stream ID.
+	streamHeaderLength = 4 + 1 + 4 + streamIDLength
+	// chunkHeaderLength is the length of the header encrypted with the data of each chunk: the stream ID, the index and the final flag.
+	chunkHeaderLength = streamIDLength + 8 + 1
+	// maxChunkOverhead is the maximum number of bytes the Cryptor may add to the plaintext of a chunk.
+	maxChunkOverhead = 64 << 10
+
+	defaultChunkSize = 1 << 20
+	maxChunkSize     = 64 << 20
+)
+
+// EncryptStream reads the plaintext from r until EOF, and writes it to w encrypted in chunks, so that large values such as attachments are neither
+// held in memory as a whole nor sent to the Cryptor as a single message. Each chunk is encrypted with its index, a flag marking the last chunk and
+// an ID unique to the stream, so that DecryptStream detects chunks that are reordered, dropped, truncated or taken from another stream. The
+// information about the field is passed to the Cryptor through ctx, see crypto.ContextWithFieldInfo.
+//
+// The stream can be stored in any []byte column that is not tagged with the D1Serializer, or outside of the database.
+func EncryptStream(ctx context.Context, cryptor crypto.Cryptor, w io.Writer, r io.Reader, opts ...StreamOption) error {
+	o := defaultStreamOptions()
+	o.apply(opts...)
+	if o.chunkSize <= 0 || o.chunkSize > maxChunkSize {
+		return fmt.Errorf("invalid chunk size %d: the maximum is %d bytes", o.chunkSize, maxChunkSize)
+	}
+
+	header := make([]byte, streamHeaderLength)
+	copy(header, streamMagic)
+	header[len(streamMagic)] = streamVersion
+	binary.BigEndian.PutUint32(header[len(streamMagic)+1:], uint32(o.chunkSize))
+	id := header[streamHeaderLength-streamIDLength:]
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	// A chunk is only written once the next one is read, to know whether it is the last.
+	chunk, next := make([]byte, o.chunkSize), make([]byte, o.chunkSize)
+	n, err := readChunk(r, chunk)
+	if err != nil {
+		return err
+	}
+	for index := uint64(0); ; index++ {
+		m := 0
+		if n == o.chunkSize {
+			if m, err = readChunk(r, next); err != nil {
+				return err
+			}
+		}
+		final := m == 0
+
+		plaintext := append(chunkHeader(id, index, final), chunk[:n]...)
+		ciphertext, err := cryptor.Encrypt(ctx, plaintext)
+		if err != nil {
+			return err
+		}
+
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(ciphertext)))
+		if _, err := w.Write(length[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(ciphertext); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+		chunk, next, n = next, chunk, m
+	}
+}
+
+// DecryptStream reads a stream written by EncryptStream from r, and writes the plaintext to w as its chunks are decrypted. It fails with
+// ErrStreamTruncated if the stream ends before its last chunk, and with crypto.ErrInvalidFormat if its chunks are out of order or were not written
+// for it. As the plaintext is written before the end of the stream is reached, it must be discarded if an error is returned.
+func DecryptStream(ctx context.Context, cryptor crypto.Cryptor, w io.Writer, r io.Reader) error {
+	header := make([]byte, streamHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return streamReadError(err)
+	}
+	if !bytes.HasPrefix(header, streamMagic) || header[len(streamMagic)] != streamVersion {
+		return fmt.Errorf("unknown stream header: %w", crypto.ErrInvalidFormat)
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(streamMagic)+1:])
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return fmt.Errorf("invalid chunk size %d: %w", chunkSize, crypto.ErrInvalidFormat)
+	}
+	id := header[streamHeaderLength-streamIDLength:]
+
+	for index := uint64(0); ; index++ {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return streamReadError(err)
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > chunkSize+chunkHeaderLength+maxChunkOverhead {
+			return fmt.Errorf("chunk %d of %d bytes: %w", index, size, crypto.ErrInvalidFormat)
+		}
+
+		ciphertext := make([]byte, size)
+		if _, err := io.ReadFull(r, ciphertext); err != nil {
+			return streamReadError(err)
+		}
+		plaintext, err := cryptor.Decrypt(ctx, ciphertext)
+		if err != nil {
+			return err
+		}
+
+		if len(plaintext) < chunkHeaderLength || len(plaintext)-chunkHeaderLength > int(chunkSize) {
+			return fmt.Errorf("chunk %d: %w", index, crypto.ErrInvalidFormat)
+		}
+		final := plaintext[chunkHeaderLength-1] == 1
+		if !bytes.Equal(plaintext[:chunkHeaderLength], chunkHeader(id, index, final)) {
+			return fmt.Errorf("chunk %d is out of order or from another stream: %w", index, crypto.ErrInvalidFormat)
+		}
+		if _, err := w.Write(plaintext[chunkHeaderLength:]); err != nil {
+			return err
+		}
+
+		if final {
+			// Nothing may follow the last chunk.
+			if n, err := r.Read(make([]byte, 1)); n > 0 || (err != nil && !errors.Is(err, io.EOF)) {
+				return fmt.Errorf("data after the last chunk: %w", crypto.ErrInvalidFormat)
+			}
+			return nil
+		}
+	}
+}
+
+// chunkHeader returns the header encrypted with the data of a chunk.
+func chunkHeader(id []byte, index uint64, final bool) []byte {
+	header := make([]byte, chunkHeaderLength)
+	copy(header, id)
+	binary.BigEndian.PutUint64(header[streamIDLength:], index)
+	if final {
+		header[chunkHeaderLength-1] = 1
+	}
+	return header
+}
+
+// readChunk reads up to len(chunk) bytes from r, and returns how many were read. Reaching EOF is not an error.
+func readChunk(r io.Reader, chunk []byte) (int, error) {
+	n, err := io.ReadFull(r, chunk)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return n, nil
+	}
+	return n, err
+}
+
+// streamReadError returns ErrStreamTruncated if the stream ended while reading, or the error otherwise.
+func streamReadError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrStreamTruncated
+	}
+	return err
+}
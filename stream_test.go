@@ -0,0 +1,125 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type countingStreamCryptor struct {
+	slowCryptor
+	encrypts int
+}
+
+func (c *countingStreamCryptor) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	c.encrypts++
+	return c.slowCryptor.Encrypt(ctx, plaintext)
+}
+
+func encryptTestStream(t *testing.T, plaintext []byte) []byte {
+	var stream bytes.Buffer
+	err := EncryptStream(context.Background(), slowCryptor{}, &stream, bytes.NewReader(plaintext), WithChunkSize(16))
+	assert.Nil(t, err)
+	return stream.Bytes()
+}
+
+// streamChunks splits a stream into its header and its length-prefixed chunks.
+func streamChunks(stream []byte) ([]byte, [][]byte) {
+	header, rest := stream[:streamHeaderLength], stream[streamHeaderLength:]
+	var chunks [][]byte
+	for len(rest) > 0 {
+		size := 4 + int(binary.BigEndian.Uint32(rest))
+		chunks = append(chunks, rest[:size])
+		rest = rest[size:]
+	}
+	return header, chunks
+}
+
+func joinStream(header []byte, chunks ...[]byte) []byte {
+	return bytes.Join(append([][]byte{header}, chunks...), nil)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	sizes := map[int]int{0: 1, 1: 1, 15: 1, 16: 1, 17: 2, 32: 2, 56: 4}
+	for size, chunks := range sizes {
+		plaintext := bytes.Repeat([]byte("x"), size)
+
+		cryptor := &countingStreamCryptor{}
+		var stream bytes.Buffer
+		err := EncryptStream(context.Background(), cryptor, &stream, bytes.NewReader(plaintext), WithChunkSize(16))
+		assert.Nil(t, err)
+		assert.Equal(t, chunks, cryptor.encrypts, "size %d", size)
+		assert.NotContains(t, stream.String(), "xxxxxxxxxxxxxxxxx")
+
+		var decrypted bytes.Buffer
+		err = DecryptStream(context.Background(), slowCryptor{}, &decrypted, &stream)
+		assert.Nil(t, err)
+		assert.Equal(t, string(plaintext), decrypted.String(), "size %d", size)
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	stream := encryptTestStream(t, bytes.Repeat([]byte("0123456789"), 5))
+	header, chunks := streamChunks(stream)
+	other, otherChunks := streamChunks(encryptTestStream(t, bytes.Repeat([]byte("0123456789"), 5)))
+
+	tests := map[string]struct {
+		stream []byte
+		err    error
+	}{
+		"reordered":            {joinStream(header, chunks[1], chunks[0], chunks[2], chunks[3]), crypto.ErrInvalidFormat},
+		"chunk dropped":        {joinStream(header, chunks[0], chunks[2], chunks[3]), crypto.ErrInvalidFormat},
+		"last chunk dropped":   {joinStream(header, chunks[:3]...), ErrStreamTruncated},
+		"truncated in chunk":   {stream[:len(stream)-1], ErrStreamTruncated},
+		"header only":          {header, ErrStreamTruncated},
+		"empty":                {nil, ErrStreamTruncated},
+		"from another stream":  {joinStream(header, chunks[0], otherChunks[1], chunks[2], chunks[3]), crypto.ErrInvalidFormat},
+		"other header":         {joinStream(other, chunks...), crypto.ErrInvalidFormat},
+		"data after last":      {append(append([]byte{}, stream...), 0), crypto.ErrInvalidFormat},
+		"not a stream":         {bytes.Repeat([]byte("x"), 64), crypto.ErrInvalidFormat},
+		"chunk size too large": {append(append(append([]byte{}, header[:5]...), 0xff, 0xff, 0xff, 0xff), stream[9:]...), crypto.ErrInvalidFormat},
+	}
+	for name, test := range tests {
+		var decrypted bytes.Buffer
+		err := DecryptStream(context.Background(), slowCryptor{}, &decrypted, bytes.NewReader(test.stream))
+		assert.ErrorIs(t, err, test.err, name)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	cryptorErr := errors.New("cryptor error")
+	cryptor := &testutil.CryptorMock{}
+	cryptor.On("Encrypt", mock.Anything, mock.Anything).Return(nil, cryptorErr)
+	cryptor.On("Decrypt", mock.Anything, mock.Anything).Return(nil, cryptorErr)
+
+	err := EncryptStream(context.Background(), cryptor, &bytes.Buffer{}, bytes.NewReader([]byte("plaintext")))
+	assert.ErrorIs(t, err, cryptorErr)
+
+	err = DecryptStream(context.Background(), cryptor, &bytes.Buffer{}, bytes.NewReader(encryptTestStream(t, []byte("plaintext"))))
+	assert.ErrorIs(t, err, cryptorErr)
+
+	err = EncryptStream(context.Background(), slowCryptor{}, &bytes.Buffer{}, bytes.NewReader(nil), WithChunkSize(0))
+	assert.NotNil(t, err)
+}
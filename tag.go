@@ -0,0 +1,42 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package d1gorm
+
+import (
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm/schema"
+)
+
+// tagName is the name of the struct tag holding the settings of encrypted fields, e.g. `d1:"mask=last4"`. Settings are separated by semicolons.
+const tagName = "d1"
+
+// tagSettings returns the settings of the d1 tag of a field, with lowercase keys.
+func tagSettings(field *schema.Field) map[string]string {
+	return parseTagSettings(field.Tag)
+}
+
+// parseTagSettings returns the settings of the d1 tag of a struct field, with lowercase keys.
+func parseTagSettings(tag reflect.StructTag) map[string]string {
+	settings := map[string]string{}
+	for _, setting := range strings.Split(tag.Get(tagName), ";") {
+		key, value, _ := strings.Cut(setting, "=")
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			settings[key] = strings.TrimSpace(value)
+		}
+	}
+	return settings
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package tracing
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/status"
+
+	"github.com/cybercryptio/d1-gorm/crypto"
+)
+
+// Attribute keys set on the spans created by the tracing instrumentation.
+const (
+	TableKey          = attribute.Key("d1gorm.table")
+	ColumnKey         = attribute.Key("d1gorm.column")
+	PayloadSizeKey    = attribute.Key("d1gorm.payload_size")
+	GrpcStatusCodeKey = attribute.Key("rpc.grpc.status_code")
+	EncryptCountKey   = attribute.Key("d1gorm.encrypt_count")
+	DecryptCountKey   = attribute.Key("d1gorm.decrypt_count")
+	RowsAffectedKey   = attribute.Key("d1gorm.rows_affected")
+)
+
+// Cryptor is an implementation of the Cryptor interface that records a span for every call to the wrapped Cryptor. The spans are children of the
+// span carried by the context, and are annotated with the table and column of the field, the size of the payload and the gRPC status of the call.
+// The plaintext and ciphertext are never recorded.
+type Cryptor struct {
+	cryptor crypto.Cryptor
+	tracer  trace.Tracer
+}
+
+// NewCryptor creates a new Cryptor that traces the calls to the provided Cryptor.
+func NewCryptor(cryptor crypto.Cryptor, opts ...Option) Cryptor {
+	o := defaultOptions()
+	o.apply(opts...)
+
+	return Cryptor{cryptor: cryptor, tracer: o.tracer()}
+}
+
+// Encrypt calls Encrypt on the wrapped Cryptor inside a new span.
+func (c Cryptor) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	if stmt, ok := statementFromContext(ctx); ok {
+		atomic.AddInt64(&stmt.encrypts, 1)
+	}
+
+	ctx, span := c.startSpan(ctx, "d1.Encrypt", len(plaintext))
+	defer span.End()
+
+	ciphertext, err := c.cryptor.Encrypt(ctx, plaintext)
+	endSpan(span, err)
+	return ciphertext, err
+}
+
+// Decrypt calls Decrypt on the wrapped Cryptor inside a new span.
+func (c Cryptor) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if stmt, ok := statementFromContext(ctx); ok {
+		atomic.AddInt64(&stmt.decrypts, 1)
+	}
+
+	ctx, span := c.startSpan(ctx, "d1.Decrypt", len(ciphertext))
+	defer span.End()
+
+	plaintext, err := c.cryptor.Decrypt(ctx, ciphertext)
+	endSpan(span, err)
+	return plaintext, err
+}
+
+func (c Cryptor) startSpan(ctx context.Context, name string, payloadSize int) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{PayloadSizeKey.Int(payloadSize)}
+	if info, ok := crypto.FieldInfoFromContext(ctx); ok {
+		attrs = append(attrs, TableKey.String(info.Table), ColumnKey.String(info.Column))
+	}
+
+	return c.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, err error) {
+	// status.Code returns codes.OK for a nil error and codes.Unknown for errors that do not originate from gRPC.
+	span.SetAttributes(GrpcStatusCodeKey.Int(int(status.Code(err))))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
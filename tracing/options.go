@@ -0,0 +1,52 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package tracing
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/cybercryptio/d1-gorm/tracing"
+
+type options struct {
+	tracerProvider trace.TracerProvider
+}
+
+// Option is used to configure optional settings for the tracing instrumentation.
+type Option func(*options)
+
+func defaultOptions() options {
+	return options{
+		tracerProvider: otel.GetTracerProvider(),
+	}
+}
+
+func (o *options) apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+func (o *options) tracer() trace.Tracer {
+	return o.tracerProvider.Tracer(instrumentationName)
+}
+
+// WithTracerProvider sets the tracer provider used to create spans. The default is the global tracer provider.
+func WithTracerProvider(tracerProvider trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracerProvider = tracerProvider
+	}
+}
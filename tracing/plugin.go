@@ -0,0 +1,118 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// Plugin is a gorm plugin that records a summary span for every statement. The spans created by the tracing Cryptor during the statement are
+// children of the summary span, which is annotated with the number of encryptions and decryptions performed. This makes patterns such as N+1
+// decryptions visible in the traces. To use it, register it with db.Use(tracing.NewPlugin()).
+type Plugin struct {
+	tracer trace.Tracer
+}
+
+// NewPlugin creates a new Plugin.
+func NewPlugin(opts ...Option) *Plugin {
+	o := defaultOptions()
+	o.apply(opts...)
+
+	return &Plugin{tracer: o.tracer()}
+}
+
+// Name returns the name of the plugin.
+func (p *Plugin) Name() string {
+	return "d1gorm:tracing"
+}
+
+// Initialize registers the callbacks of the plugin.
+func (p *Plugin) Initialize(db *gorm.DB) error {
+	callback := db.Callback()
+	operations := []struct {
+		name   string
+		before func(name string, fn func(*gorm.DB)) error
+		after  func(name string, fn func(*gorm.DB)) error
+	}{
+		{"create", callback.Create().Before("*").Register, callback.Create().After("*").Register},
+		{"query", callback.Query().Before("*").Register, callback.Query().After("*").Register},
+		{"update", callback.Update().Before("*").Register, callback.Update().After("*").Register},
+		{"delete", callback.Delete().Before("*").Register, callback.Delete().After("*").Register},
+		{"row", callback.Row().Before("*").Register, callback.Row().After("*").Register},
+		{"raw", callback.Raw().Before("*").Register, callback.Raw().After("*").Register},
+	}
+
+	for _, op := range operations {
+		if err := op.before(p.Name()+":before_"+op.name, p.before(op.name)); err != nil {
+			return err
+		}
+		if err := op.after(p.Name()+":after_"+op.name, p.after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type statement struct {
+	parent   trace.Span
+	span     trace.Span
+	encrypts int64
+	decrypts int64
+}
+
+type statementCtxKey struct{}
+
+func statementFromContext(ctx context.Context) (*statement, bool) {
+	stmt, ok := ctx.Value(statementCtxKey{}).(*statement)
+	return stmt, ok && stmt != nil
+}
+
+func (p *Plugin) before(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		parent := db.Statement.Context
+		ctx, span := p.tracer.Start(parent, "d1gorm."+operation, trace.WithSpanKind(trace.SpanKindInternal))
+		db.Statement.Context = context.WithValue(ctx, statementCtxKey{}, &statement{parent: trace.SpanFromContext(parent), span: span})
+	}
+}
+
+func (p *Plugin) after(db *gorm.DB) {
+	stmt, ok := statementFromContext(db.Statement.Context)
+	if !ok {
+		return
+	}
+
+	stmt.span.SetAttributes(
+		TableKey.String(db.Statement.Table),
+		EncryptCountKey.Int64(atomic.LoadInt64(&stmt.encrypts)),
+		DecryptCountKey.Int64(atomic.LoadInt64(&stmt.decrypts)),
+		RowsAffectedKey.Int64(db.RowsAffected),
+	)
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		stmt.span.RecordError(db.Error)
+		stmt.span.SetStatus(codes.Error, db.Error.Error())
+	}
+	stmt.span.End()
+
+	// Remove the span and the statement from the context, so that a statement reusing the same *gorm.DB does not become a child of this span. The
+	// context is otherwise kept, since other plugins may have added values to it after this plugin did.
+	ctx := context.WithValue(db.Statement.Context, statementCtxKey{}, (*statement)(nil))
+	db.Statement.Context = trace.ContextWithSpan(ctx, stmt.parent)
+}
@@ -0,0 +1,212 @@
+// Copyright 2022 CYBERCRYPT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	d1gorm "github.com/cybercryptio/d1-gorm"
+	"github.com/cybercryptio/d1-gorm/testutil"
+)
+
+type Person struct {
+	ID        int
+	FirstName string
+	LastName  string `gorm:"serializer:D1"`
+}
+
+func newTracerProvider() (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	return sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), recorder
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func spansByName(spans []sdktrace.ReadOnlySpan, name string) []sdktrace.ReadOnlySpan {
+	var found []sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.Name() == name {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+func TestCryptorSpans(t *testing.T) {
+	tp, recorder := newTracerProvider()
+
+	plaintext := []byte("Doe")
+	ciphertext := []byte("Doencrypt")
+
+	cryptorMock := &testutil.CryptorMock{}
+	cryptorMock.On("Encrypt", mock.Anything, plaintext).Once().Return(ciphertext, nil)
+	cryptorMock.On("Decrypt", mock.Anything, ciphertext).Once().Return(nil, status.Error(grpccodes.PermissionDenied, "denied"))
+
+	cryptor := NewCryptor(cryptorMock, WithTracerProvider(tp))
+
+	_, err := cryptor.Encrypt(context.Background(), plaintext)
+	assert.Nil(t, err)
+	_, err = cryptor.Decrypt(context.Background(), ciphertext)
+	assert.NotNil(t, err)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+
+	assert.Equal(t, "d1.Encrypt", spans[0].Name())
+	attrs := attributes(spans[0])
+	assert.Equal(t, int64(len(plaintext)), attrs[PayloadSizeKey].AsInt64())
+	assert.Equal(t, int64(grpccodes.OK), attrs[GrpcStatusCodeKey].AsInt64())
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+
+	assert.Equal(t, "d1.Decrypt", spans[1].Name())
+	attrs = attributes(spans[1])
+	assert.Equal(t, int64(len(ciphertext)), attrs[PayloadSizeKey].AsInt64())
+	assert.Equal(t, int64(grpccodes.PermissionDenied), attrs[GrpcStatusCodeKey].AsInt64())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+
+	for _, span := range spans {
+		for _, kv := range span.Attributes() {
+			assert.NotContains(t, kv.Value.Emit(), string(plaintext))
+		}
+	}
+	cryptorMock.AssertExpectations(t)
+}
+
+func TestPluginStatementSpans(t *testing.T) {
+	tp, recorder := newTracerProvider()
+
+	cryptorMock := &testutil.CryptorMock{}
+	for i := 0; i < 3; i++ {
+		lastName := fmt.Sprintf("Doe%d", i)
+		encryptedLastName := fmt.Sprintf("Doencrypt%d", i)
+		cryptorMock.On("Encrypt", mock.Anything, []byte(lastName)).Return([]byte(encryptedLastName), nil)
+		cryptorMock.On("Decrypt", mock.Anything, []byte(encryptedLastName)).Once().Return([]byte(lastName), nil)
+	}
+
+	schema.RegisterSerializer("D1", d1gorm.NewD1Serializer(NewCryptor(cryptorMock, WithTracerProvider(tp))))
+
+	db := testutil.NewTestDB(t)
+	err := db.AutoMigrate(&Person{})
+	assert.Nil(t, err)
+
+	err = db.Use(NewPlugin(WithTracerProvider(tp)))
+	assert.Nil(t, err)
+
+	people := []Person{{1, "John", "Doe0"}, {2, "Jane", "Doe1"}, {3, "Jim", "Doe2"}}
+	err = db.Create(&people).Error
+	assert.Nil(t, err)
+
+	var found []Person
+	err = db.Find(&found).Error
+	assert.Nil(t, err)
+	assert.Equal(t, people, found)
+
+	spans := recorder.Ended()
+
+	creates := spansByName(spans, "d1gorm.create")
+	assert.Len(t, creates, 1)
+	attrs := attributes(creates[0])
+	assert.Equal(t, "people", attrs[TableKey].AsString())
+	assert.Equal(t, int64(3), attrs[EncryptCountKey].AsInt64())
+	assert.Equal(t, int64(0), attrs[DecryptCountKey].AsInt64())
+
+	queries := spansByName(spans, "d1gorm.query")
+	assert.Len(t, queries, 1)
+	attrs = attributes(queries[0])
+	assert.Equal(t, int64(0), attrs[EncryptCountKey].AsInt64())
+	assert.Equal(t, int64(3), attrs[DecryptCountKey].AsInt64())
+	assert.Equal(t, int64(3), attrs[RowsAffectedKey].AsInt64())
+
+	decrypts := spansByName(spans, "d1.Decrypt")
+	assert.Len(t, decrypts, 3)
+	for _, span := range decrypts {
+		assert.Equal(t, queries[0].SpanContext().SpanID(), span.Parent().SpanID())
+		attrs := attributes(span)
+		assert.Equal(t, "people", attrs[TableKey].AsString())
+		assert.Equal(t, "last_name", attrs[ColumnKey].AsString())
+	}
+	cryptorMock.AssertExpectations(t)
+}
+
+func TestPluginWithD1Plugin(t *testing.T) {
+	for _, d1First := range []bool{true, false} {
+		t.Run(fmt.Sprintf("d1First=%t", d1First), func(t *testing.T) {
+			tp, recorder := newTracerProvider()
+
+			cryptorMock := &testutil.CryptorMock{}
+			for _, lastName := range []string{"Doe", "Roe"} {
+				cryptorMock.On("Encrypt", mock.Anything, []byte(lastName)).Return([]byte(lastName+"encrypt"), nil)
+			}
+			cryptorMock.On("Decrypt", mock.Anything, []byte("Doeencrypt")).Return([]byte("Doe"), nil)
+			cryptorMock.On("Decrypt", mock.Anything, []byte("Roeencrypt")).Return(nil, status.Error(grpccodes.PermissionDenied, "denied"))
+			schema.RegisterSerializer("D1", d1gorm.NewD1Serializer(NewCryptor(cryptorMock, WithTracerProvider(tp))))
+
+			db := testutil.NewTestDB(t)
+			plugins := []gorm.Plugin{d1gorm.NewPlugin(d1gorm.WithDecryptErrorPolicy(d1gorm.DecryptErrorZero)), NewPlugin(WithTracerProvider(tp))}
+			if !d1First {
+				plugins[0], plugins[1] = plugins[1], plugins[0]
+			}
+			for _, plugin := range plugins {
+				err := db.Use(plugin)
+				assert.Nil(t, err)
+			}
+			err := db.AutoMigrate(&Person{})
+			assert.Nil(t, err)
+
+			err = db.Create(&[]Person{{1, "John", "Doe"}, {2, "Jane", "Roe"}}).Error
+			assert.Nil(t, err)
+
+			// The state of the d1gorm Plugin outlives the statement, and a reused statement starts over
+			tx := db.Model(&Person{}).Order("id")
+			for i := 0; i < 2; i++ {
+				var found []Person
+				err = tx.Find(&found).Error
+				assert.Nil(t, err)
+				assert.Equal(t, []Person{{1, "John", "Doe"}, {2, "Jane", ""}}, found)
+
+				stats, ok := d1gorm.StatementStatsFromContext(tx.Statement.Context)
+				assert.True(t, ok)
+				assert.Equal(t, 2, stats.Decrypts)
+				assert.Len(t, d1gorm.DecryptErrors(tx), 1)
+			}
+
+			queries := spansByName(recorder.Ended(), "d1gorm.query")
+			assert.Len(t, queries, 2)
+			for _, query := range queries {
+				assert.False(t, query.Parent().IsValid())
+				assert.Equal(t, int64(2), attributes(query)[DecryptCountKey].AsInt64())
+			}
+		})
+	}
+}